@@ -0,0 +1,192 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"sync"
+	"time"
+)
+
+// Adaptive concurrency algorithm names used in pool config
+const (
+	adaptiveGradient = "gradient"
+	adaptiveAIMD     = "aimd"
+)
+
+// Adaptive concurrency defaults, used for fields left unset
+const (
+	defaultAdaptiveInitialLimit     = 20
+	defaultAdaptiveMinLimit         = 1
+	defaultAdaptiveMaxLimit         = 1000
+	defaultAdaptiveSmoothing        = 0.2
+	defaultAdaptiveTolerance        = 1.5
+	defaultAdaptiveBackoffRatio     = 0.9
+	defaultAdaptiveLatencyThreshold = time.Second
+
+	// adaptiveLongWindow is how many samples the gradient's long-term
+	// latency averages over
+	adaptiveLongWindow = 600
+)
+
+var errLimitExceeded = errors.New("adaptive concurrency limit reached")
+
+// AdaptiveLimiter discovers how many concurrent requests a backend can take,
+// in the style of Netflix's concurrency-limits, and sheds requests over that
+// limit. The gradient algorithm compares each request's latency to a
+// long-term average: while they match the limit grows, and as latency
+// inflates from queueing in the backend it shrinks. AIMD adds one to the
+// limit for each success and cuts it by BackoffRatio when a request fails or
+// takes longer than LatencyThreshold.
+type AdaptiveLimiter struct {
+	Algorithm        string // empty when disabled
+	MinLimit         int
+	MaxLimit         int
+	Smoothing        float64
+	Tolerance        float64
+	BackoffRatio     float64
+	LatencyThreshold time.Duration
+
+	limit    float64
+	longRTT  float64
+	inFlight int
+	mu       sync.Mutex
+}
+
+// AdaptiveLimiter.Configure applies a pool's settings, which may be nil to
+// disable the limiter. A limiter that was already running keeps its current
+// limit within the new bounds.
+func (al *AdaptiveLimiter) Configure(ac *AdaptiveConcurrencyConfig) {
+	al.mu.Lock()
+	defer al.mu.Unlock()
+
+	if ac == nil {
+		al.Algorithm = ""
+		return
+	}
+
+	wasEnabled := al.Algorithm != ""
+	al.Algorithm = ac.Algorithm
+	if al.Algorithm == "" {
+		al.Algorithm = adaptiveGradient
+	}
+	al.MinLimit = orDefault(ac.MinLimit, defaultAdaptiveMinLimit)
+	al.MaxLimit = orDefault(ac.MaxLimit, defaultAdaptiveMaxLimit)
+	al.Smoothing = ac.Smoothing
+	if al.Smoothing == 0 {
+		al.Smoothing = defaultAdaptiveSmoothing
+	}
+	al.Tolerance = ac.Tolerance
+	if al.Tolerance == 0 {
+		al.Tolerance = defaultAdaptiveTolerance
+	}
+	al.BackoffRatio = ac.BackoffRatio
+	if al.BackoffRatio == 0 {
+		al.BackoffRatio = defaultAdaptiveBackoffRatio
+	}
+	al.LatencyThreshold = ac.LatencyThreshold
+	if al.LatencyThreshold == 0 {
+		al.LatencyThreshold = defaultAdaptiveLatencyThreshold
+	}
+
+	if !wasEnabled {
+		al.limit = float64(orDefault(ac.InitialLimit, defaultAdaptiveInitialLimit))
+		al.longRTT = 0
+	}
+	al.clamp()
+}
+
+// AdaptiveLimiter.Acquire takes a slot, reporting false if the backend is
+// at its limit. On success the caller must call Release.
+func (al *AdaptiveLimiter) Acquire() bool {
+	al.mu.Lock()
+	defer al.mu.Unlock()
+
+	if al.Algorithm != "" && al.inFlight >= int(al.limit) {
+		return false
+	}
+	al.inFlight++
+	return true
+}
+
+// AdaptiveLimiter.Release returns a slot and adjusts the limit from the
+// request's latency and whether it failed
+func (al *AdaptiveLimiter) Release(rtt time.Duration, failed bool) {
+	al.mu.Lock()
+	defer al.mu.Unlock()
+
+	inFlight := al.inFlight
+	al.inFlight--
+
+	switch al.Algorithm {
+	case adaptiveGradient:
+		al.updateGradient(float64(rtt), inFlight, failed)
+	case adaptiveAIMD:
+		al.updateAIMD(rtt, inFlight, failed)
+	default:
+		return
+	}
+	al.clamp()
+}
+
+// updateGradient applies the gradient algorithm. The caller holds al.mu.
+func (al *AdaptiveLimiter) updateGradient(rtt float64, inFlight int, failed bool) {
+	// Fast failures say nothing about queueing in the backend
+	if failed || rtt <= 0 {
+		return
+	}
+
+	if al.longRTT == 0 {
+		al.longRTT = rtt
+	} else {
+		al.longRTT += (rtt - al.longRTT) / adaptiveLongWindow
+	}
+
+	// Let the long-term average recover faster after a latency spike
+	if al.longRTT/rtt > 2 {
+		al.longRTT *= 0.95
+	}
+
+	// Only grow when the limit is actually being used
+	if float64(inFlight) < al.limit/2 {
+		return
+	}
+
+	gradient := math.Max(0.5, math.Min(1, al.Tolerance*al.longRTT/rtt))
+	newLimit := al.limit*gradient + math.Sqrt(al.limit)
+	al.limit = al.limit*(1-al.Smoothing) + newLimit*al.Smoothing
+}
+
+// updateAIMD applies additive increase, multiplicative decrease. The caller
+// holds al.mu.
+func (al *AdaptiveLimiter) updateAIMD(rtt time.Duration, inFlight int, failed bool) {
+	if failed || rtt > al.LatencyThreshold {
+		al.limit *= al.BackoffRatio
+		return
+	}
+	if float64(inFlight)*2 >= al.limit {
+		al.limit++
+	}
+}
+
+// clamp keeps the limit within bounds. The caller holds al.mu.
+func (al *AdaptiveLimiter) clamp() {
+	al.limit = math.Max(float64(al.MinLimit), math.Min(float64(al.MaxLimit), al.limit))
+}
+
+// AdaptiveLimiter.Limit returns the current limit, or 0 when disabled
+func (al *AdaptiveLimiter) Limit() int {
+	al.mu.Lock()
+	defer al.mu.Unlock()
+	if al.Algorithm == "" {
+		return 0
+	}
+	return int(al.limit)
+}
+
+// orDefault returns v, or def if v is zero
+func orDefault(v, def int) int {
+	if v == 0 {
+		return def
+	}
+	return v
+}
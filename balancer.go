@@ -0,0 +1,291 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"math/rand"
+	"net/http"
+	"time"
+)
+
+// Load balancing strategy names used in pool config
+const (
+	strategyRoundRobin    = "round_robin"
+	strategyLeastRequests = "least_requests"
+	strategyP2CEWMA       = "p2c_ewma"
+	strategyRingHash      = "ring_hash"
+)
+
+// ewmaDecay is how quickly observed latency is forgotten by peak EWMA
+const ewmaDecay = 10 * time.Second
+
+// Strategy picks a backend for a request. Candidates are alive and have a
+// positive weight. Pick is called with the LoadBalancer's lock held.
+type Strategy interface {
+	Name() string
+	Pick(candidates []*Backend, r *http.Request) *Backend
+}
+
+// newStrategy returns the strategy configured for a pool
+func newStrategy(pc PoolConfig) (Strategy, error) {
+	switch pc.Strategy {
+	case "", strategyRoundRobin:
+		return &roundRobin{}, nil
+	case strategyLeastRequests:
+		return &leastRequests{}, nil
+	case strategyP2CEWMA:
+		return &p2cEWMA{}, nil
+	case strategyRingHash:
+		return newRingHash(pc.HashKey, pc.HashLoadFactor)
+	}
+	return nil, fmt.Errorf("unknown strategy %q (want %s, %s, %s or %s)",
+		pc.Strategy, strategyRoundRobin, strategyLeastRequests, strategyP2CEWMA, strategyRingHash)
+}
+
+// roundRobin is smooth weighted round-robin (as in nginx): every pick adds
+// each backend's weight to its current weight, the highest current weight
+// wins and is reduced by the total. Over any window each backend gets its
+// share of picks, spread out rather than in bursts.
+type roundRobin struct{}
+
+func (roundRobin) Name() string { return strategyRoundRobin }
+
+func (roundRobin) Pick(candidates []*Backend, r *http.Request) *Backend {
+	var best *Backend
+	total := 0
+	for _, b := range candidates {
+		b.currentWeight += b.Weight
+		total += b.Weight
+		if best == nil || b.currentWeight > best.currentWeight {
+			best = b
+		}
+	}
+
+	if best != nil {
+		best.currentWeight -= total
+	}
+	return best
+}
+
+// leastRequests picks the backend with the fewest in-flight requests
+// relative to its weight. Ties are broken randomly so idle backends share
+// the load.
+type leastRequests struct{}
+
+func (leastRequests) Name() string { return strategyLeastRequests }
+
+func (leastRequests) Pick(candidates []*Backend, r *http.Request) *Backend {
+	var best *Backend
+	bestLoad, ties := 0.0, 0
+	for _, b := range candidates {
+		load := float64(b.InFlight()) / float64(b.Weight)
+		switch {
+		case best == nil || load < bestLoad:
+			best, bestLoad, ties = b, load, 1
+		case load == bestLoad:
+			ties++
+			if rand.Intn(ties) == 0 {
+				best = b
+			}
+		}
+	}
+	return best
+}
+
+// p2cEWMA is power-of-two-choices over peak-EWMA latency: pick two backends
+// at random and send the request to the one with the lower expected cost,
+// its latency estimate times its queue depth.
+type p2cEWMA struct{}
+
+func (p2cEWMA) Name() string { return strategyP2CEWMA }
+
+func (p2cEWMA) Pick(candidates []*Backend, r *http.Request) *Backend {
+	switch len(candidates) {
+	case 0:
+		return nil
+	case 1:
+		return candidates[0]
+	}
+
+	i := rand.Intn(len(candidates))
+	j := rand.Intn(len(candidates) - 1)
+	if j >= i {
+		j++
+	}
+
+	a, b := candidates[i], candidates[j]
+	if b.cost() < a.cost() {
+		return b
+	}
+	return a
+}
+
+// ProxyResult is the outcome of proxying one request to a backend
+type ProxyResult struct {
+	Status  int
+	Err     error // transport error, if the backend could not be reached
+	Latency time.Duration
+	Held    bool // the response was discarded so the request can be retried
+	Aborted bool // the response body was cut off partway through
+
+	// Time spent and queue depth joined waiting under the backend's
+	// concurrency limit
+	QueueWait  time.Duration
+	QueueDepth int
+}
+
+// errResponseAborted is the error of a response cut off by the backend
+var errResponseAborted = errors.New("response body aborted")
+
+// proxyResultKey carries a *ProxyResult in the request context so the
+// ReverseProxy error handler can report transport errors
+type proxyResultKey struct{}
+
+// Backend.Forward proxies a request, tracking in-flight requests and latency
+// for the balancing strategies. The request first waits for a slot under the
+// backend's concurrency limit and gets a 503 if none frees up or the adaptive
+// limiter sheds it. If hold is set it is asked, once the status is known,
+// whether to discard the response and retry instead.
+func (b *Backend) Forward(w http.ResponseWriter, r *http.Request, hold func(status int, err error) bool) ProxyResult {
+	b.inFlight.Add(1)
+	defer b.inFlight.Add(-1)
+
+	res := &ProxyResult{}
+	r = r.WithContext(context.WithValue(r.Context(), proxyResultKey{}, res))
+
+	var aw *attemptWriter
+	if hold != nil {
+		aw = &attemptWriter{
+			ResponseWriter: w,
+			header:         make(http.Header),
+			hold:           func(status int) bool { return hold(status, res.Err) },
+		}
+		w = aw
+	}
+	rw := &responseWriter{ResponseWriter: w, statusCode: http.StatusOK}
+
+	var err error
+	res.QueueWait, res.QueueDepth, err = b.queue.Acquire(r.Context(), requestPriority(r.Context()))
+	if err != nil {
+		res.Err = err
+		if isOverloaded(err) {
+			writeOverloaded(rw, b.queue.RetryAfter(), err)
+		} else {
+			proxyErrorHandler(rw, r, err)
+		}
+		res.Status = rw.statusCode
+		res.Held = aw != nil && aw.held
+		return *res
+	}
+	defer b.queue.Release()
+
+	if !b.adaptive.Acquire() {
+		res.Err = errLimitExceeded
+		writeOverloaded(rw, time.Second, errLimitExceeded)
+		res.Status = rw.statusCode
+		res.Held = aw != nil && aw.held
+		return *res
+	}
+
+	start := time.Now()
+	defer func() {
+		// Cancelled hedges and departed clients aren't the backend's fault,
+		// but a request that never got a status is
+		latency := time.Since(start)
+		failed := res.Status == 0 || res.Status >= 500
+		if res.Err != nil {
+			failed = !errors.Is(res.Err, context.Canceled)
+		}
+		b.adaptive.Release(latency, failed)
+		b.observeLatency(latency)
+	}()
+
+	b.serve(rw, r, res)
+	res.Latency = time.Since(start)
+	res.Status = rw.statusCode
+	res.Held = aw != nil && aw.held
+	return *res
+}
+
+// Backend.serve runs the reverse proxy. When copying a response body fails
+// the proxy panics with http.ErrAbortHandler to cut off the client; serve
+// records that in res instead, so the caller can finish its bookkeeping
+// (and hedged attempts, which run on their own goroutines, don't take the
+// process down) before passing the abort on.
+func (b *Backend) serve(w http.ResponseWriter, r *http.Request, res *ProxyResult) {
+	defer func() {
+		if v := recover(); v != nil {
+			if v != http.ErrAbortHandler {
+				panic(v)
+			}
+			res.Aborted = true
+			if res.Err = r.Context().Err(); res.Err == nil {
+				res.Err = errResponseAborted
+			}
+		}
+	}()
+	b.Proxy.ServeHTTP(w, r)
+}
+
+// proxyErrorHandler replies 504 to timeouts and 502 to other transport
+// errors, and records them in the request's ProxyResult
+func proxyErrorHandler(w http.ResponseWriter, r *http.Request, err error) {
+	if res, ok := r.Context().Value(proxyResultKey{}).(*ProxyResult); ok {
+		res.Err = err
+	}
+	// Cancelled hedges and departed clients aren't worth logging
+	if !errors.Is(err, context.Canceled) {
+		log.Printf("http: proxy error: %v", err)
+	}
+	if isTimeout(err) {
+		writeTimeout(w)
+		return
+	}
+	w.WriteHeader(http.StatusBadGateway)
+}
+
+// Backend.IsAlive reports whether active health checks consider the backend
+// healthy
+func (b *Backend) IsAlive() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.Alive
+}
+
+// Backend.InFlight returns the number of requests being proxied
+func (b *Backend) InFlight() int64 {
+	return b.inFlight.Load()
+}
+
+// Backend.Latency returns the peak-EWMA latency estimate
+func (b *Backend) Latency() time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return time.Duration(b.ewma)
+}
+
+// Backend.observeLatency updates the peak-EWMA estimate. Latency spikes are
+// taken immediately; improvements are blended in over ewmaDecay.
+func (b *Backend) observeLatency(rtt time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	sample := float64(rtt)
+	if b.ewma == 0 || sample > b.ewma {
+		b.ewma = sample
+	} else {
+		w := math.Exp(-float64(now.Sub(b.ewmaUpdated)) / float64(ewmaDecay))
+		b.ewma = b.ewma*w + sample*(1-w)
+	}
+	b.ewmaUpdated = now
+}
+
+// Backend.cost estimates how long a new request would take. Backends without
+// latency samples cost nothing, so new backends get probed quickly.
+func (b *Backend) cost() float64 {
+	return float64(b.Latency()) * float64(b.InFlight()+1) / float64(b.Weight)
+}
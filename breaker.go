@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// Circuit breaker defaults, used for fields left unset
+const (
+	defaultBreakerWindow           = 10 * time.Second
+	defaultBreakerFailureRate      = 0.5
+	defaultBreakerMinRequests      = 20
+	defaultBreakerOpenDuration     = 30 * time.Second
+	defaultBreakerHalfOpenRequests = 3
+
+	// breakerBuckets is how many slices the rolling window is counted in
+	breakerBuckets = 10
+)
+
+// Circuit breaker states
+const (
+	breakerClosed   = "closed"
+	breakerOpen     = "open"
+	breakerHalfOpen = "half_open"
+)
+
+// CircuitBreaker stops sending traffic to a backend whose failure rate over
+// a rolling window crosses a threshold. After OpenDuration the breaker goes
+// half-open and lets HalfOpenRequests trial requests through: if they all
+// succeed it closes, if any fails it opens again, and if they have not all
+// finished within another OpenDuration it opens again too. A failure is a
+// transport error or a 5xx response; requests cancelled by the client are
+// not counted.
+type CircuitBreaker struct {
+	Window           time.Duration
+	FailureRate      float64
+	MinRequests      int
+	OpenDuration     time.Duration
+	HalfOpenRequests int
+}
+
+// breakerState is a backend's circuit breaker state, guarded by its mu
+type breakerState struct {
+	state    string
+	openedAt time.Time
+	buckets  [breakerBuckets]breakerBucket
+
+	// Half-open since, and trial requests sent and succeeded
+	halfOpenAt time.Time
+	trials     int
+	successes  int
+}
+
+// breakerBucket counts outcomes for one slice of the rolling window
+type breakerBucket struct {
+	epoch     int64
+	successes int
+	failures  int
+}
+
+// newCircuitBreaker builds a pool's circuit breaker from its config. It
+// returns nil when the pool has none configured.
+func newCircuitBreaker(bc *CircuitBreakerConfig) *CircuitBreaker {
+	if bc == nil {
+		return nil
+	}
+
+	cb := &CircuitBreaker{
+		Window:           bc.Window,
+		FailureRate:      bc.FailureRate,
+		MinRequests:      bc.MinRequests,
+		OpenDuration:     bc.OpenDuration,
+		HalfOpenRequests: bc.HalfOpenRequests,
+	}
+	if cb.Window == 0 {
+		cb.Window = defaultBreakerWindow
+	}
+	if cb.FailureRate == 0 {
+		cb.FailureRate = defaultBreakerFailureRate
+	}
+	if cb.MinRequests == 0 {
+		cb.MinRequests = defaultBreakerMinRequests
+	}
+	if cb.OpenDuration == 0 {
+		cb.OpenDuration = defaultBreakerOpenDuration
+	}
+	if cb.HalfOpenRequests == 0 {
+		cb.HalfOpenRequests = defaultBreakerHalfOpenRequests
+	}
+	return cb
+}
+
+// CircuitBreaker.allows reports whether b can take a request. An open
+// breaker whose OpenDuration has passed allows the request that will make
+// it half-open, and a half-open breaker whose trials are stuck opens again.
+func (cb *CircuitBreaker) allows(b *Backend, now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.breaker.state {
+	case breakerOpen:
+		return !now.Before(b.breaker.openedAt.Add(cb.OpenDuration))
+	case breakerHalfOpen:
+		if b.breaker.trials < cb.HalfOpenRequests {
+			return true
+		}
+		if !now.Before(b.breaker.halfOpenAt.Add(cb.OpenDuration)) {
+			cb.open(b, now, fmt.Sprintf("trial requests did not finish within %v", cb.OpenDuration))
+		}
+		return false
+	}
+	return true
+}
+
+// CircuitBreaker.acquire records that a request is being sent to b, which
+// allows has approved
+func (cb *CircuitBreaker) acquire(b *Backend, now time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.breaker.state == breakerOpen && !now.Before(b.breaker.openedAt.Add(cb.OpenDuration)) {
+		b.breaker.state = breakerHalfOpen
+		b.breaker.halfOpenAt = now
+		b.breaker.trials = 0
+		b.breaker.successes = 0
+		log.Printf("Backend %s circuit breaker is now half-open", b.URL.String())
+	}
+	if b.breaker.state == breakerHalfOpen {
+		b.breaker.trials++
+	}
+}
+
+// CircuitBreaker.Release gives back the half-open trial taken by a request
+// to b whose outcome will not be recorded
+func (cb *CircuitBreaker) Release(b *Backend) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.breaker.state == breakerHalfOpen && b.breaker.trials > b.breaker.successes {
+		b.breaker.trials--
+	}
+}
+
+// CircuitBreaker.Record counts the outcome of a request to b and moves the
+// breaker between states. A request cancelled by the client is released
+// instead.
+func (cb *CircuitBreaker) Record(b *Backend, res ProxyResult) {
+	if errors.Is(res.Err, context.Canceled) {
+		cb.Release(b)
+		return
+	}
+	failed := res.Err != nil || res.Status >= 500
+	now := time.Now()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.breaker.state {
+	case breakerHalfOpen:
+		if failed {
+			cb.open(b, now, "trial request failed")
+			return
+		}
+		b.breaker.successes++
+		if b.breaker.successes >= cb.HalfOpenRequests {
+			b.breaker.state = breakerClosed
+			b.breaker.buckets = [breakerBuckets]breakerBucket{}
+			log.Printf("Backend %s circuit breaker is now closed", b.URL.String())
+		}
+
+	case breakerClosed, "":
+		bucket := cb.bucket(b, now)
+		if failed {
+			bucket.failures++
+		} else {
+			bucket.successes++
+		}
+
+		successes, failures := cb.counts(b, now)
+		total := successes + failures
+		if total >= cb.MinRequests && float64(failures) >= cb.FailureRate*float64(total) {
+			cb.open(b, now, fmt.Sprintf("%d of %d requests failed", failures, total))
+		}
+	}
+}
+
+// open trips the breaker. The caller holds b.mu.
+func (cb *CircuitBreaker) open(b *Backend, now time.Time, reason string) {
+	b.breaker.state = breakerOpen
+	b.breaker.openedAt = now
+	log.Printf("Backend %s circuit breaker is now open: %s", b.URL.String(), reason)
+}
+
+// bucket returns the window slice for now, clearing it if it holds counts
+// from an earlier pass around the window. The caller holds b.mu.
+func (cb *CircuitBreaker) bucket(b *Backend, now time.Time) *breakerBucket {
+	epoch := now.UnixNano() / int64(cb.Window/breakerBuckets)
+	bucket := &b.breaker.buckets[epoch%breakerBuckets]
+	if bucket.epoch != epoch {
+		*bucket = breakerBucket{epoch: epoch}
+	}
+	return bucket
+}
+
+// counts sums the outcomes within the rolling window. The caller holds b.mu.
+func (cb *CircuitBreaker) counts(b *Backend, now time.Time) (successes, failures int) {
+	epoch := now.UnixNano() / int64(cb.Window/breakerBuckets)
+	for _, bucket := range b.breaker.buckets {
+		if epoch-bucket.epoch < breakerBuckets {
+			successes += bucket.successes
+			failures += bucket.failures
+		}
+	}
+	return successes, failures
+}
+
+// Backend.BreakerState returns the state of the backend's circuit breaker
+func (b *Backend) BreakerState() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.breaker.state == "" {
+		return breakerClosed
+	}
+	return b.breaker.state
+}
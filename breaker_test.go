@@ -0,0 +1,46 @@
+package main
+
+import "testing"
+
+// TestBreakerRemovedOnReload checks that reloading without a circuit breaker
+// closes any breaker that was open
+func TestBreakerRemovedOnReload(t *testing.T) {
+	const pool = `
+backends:
+  - http://localhost:8081
+  - http://localhost:8082
+`
+	router := testRouter(t, pool+`
+pools:
+  default:
+    circuit_breaker:
+      min_requests: 2
+`)
+	lb := router.pools[defaultPool].LB
+	b := lb.backends[0]
+	for i := 0; i < 2; i++ {
+		lb.Breaker().Record(b, ProxyResult{Status: 502})
+	}
+	if b.BreakerState() != breakerOpen || !lb.BreakersOpen() {
+		t.Fatalf("breaker %s, want open", b.BreakerState())
+	}
+
+	config, err := ParseConfig("test.yaml", []byte(pool))
+	if err != nil {
+		t.Fatal(err)
+	}
+	reloaded, err := NewRouter(config, router)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lb = reloaded.pools[defaultPool].LB
+	if lb.backends[0] != b {
+		t.Fatal("reload replaced the backend")
+	}
+	if state := b.BreakerState(); state != breakerClosed {
+		t.Errorf("breaker %s after reload, want closed", state)
+	}
+	if lb.BreakersOpen() {
+		t.Error("BreakersOpen after the breaker was removed")
+	}
+}
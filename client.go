@@ -214,7 +214,7 @@ func testRateLimit(client *TestClient, count int) {
 	fmt.Printf("Testing rate limiting (%d requests)...\n", count)
 	successCount := 0
 	for i := 1; i <= count; i++ {
-		resp, code, err := client.Get("/api/user")
+		_, code, err := client.Get("/api/user")
 		if err != nil {
 			log.Printf("Request %d error: %v", i, err)
 			continue
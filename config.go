@@ -0,0 +1,1056 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Default gateway settings, used when neither the config file nor a flag sets a value
+const (
+	defaultListenAddr          = ":8080"
+	defaultLogFile             = "gateway.log"
+	defaultRateLimitPerIP      = 100
+	defaultRateLimitPerKey     = 1000
+	defaultHealthCheckInterval = 10 * time.Second
+	defaultPool                = "default"
+)
+
+// FileConfig is the on-disk gateway configuration (YAML or JSON)
+type FileConfig struct {
+	Listen              string                 `yaml:"listen"`
+	LogFile             string                 `yaml:"log_file"`
+	Backends            []BackendConfig        `yaml:"backends"`
+	HealthCheckInterval time.Duration          `yaml:"health_check_interval"`
+	RateLimit           RateLimitConfig        `yaml:"rate_limit"`
+	RetryBudget         RetryBudgetConfig      `yaml:"retry_budget"`
+	Timeouts            TimeoutConfig          `yaml:"timeouts"`
+	APIKeys             []APIKeyConfig         `yaml:"api_keys"`
+	LoadShedding        *LoadSheddingConfig    `yaml:"load_shedding"`
+	Shutdown            ShutdownConfig         `yaml:"shutdown"`
+	Pools               map[string]PoolConfig  `yaml:"pools"`
+	Routes              []RouteConfig          `yaml:"routes"`
+	NotFound            map[string]interface{} `yaml:"not_found"`
+}
+
+// PoolConfig defines a named group of backends and how to balance them. The
+// "default" pool takes its backends from the top-level backends list.
+type PoolConfig struct {
+	Backends         []BackendConfig            `yaml:"backends"`
+	Strategy         string                     `yaml:"strategy"`
+	HashKey          string                     `yaml:"hash_key"`
+	HashLoadFactor   float64                    `yaml:"hash_load_factor"`
+	Sticky           *StickyConfig              `yaml:"sticky"`
+	HealthCheck      *HealthCheckConfig         `yaml:"health_check"`
+	OutlierDetection *OutlierConfig             `yaml:"outlier_detection"`
+	CircuitBreaker   *CircuitBreakerConfig      `yaml:"circuit_breaker"`
+	Concurrency      *ConcurrencyConfig         `yaml:"concurrency"`
+	Adaptive         *AdaptiveConcurrencyConfig `yaml:"adaptive_concurrency"`
+}
+
+// AdaptiveConcurrencyConfig enables adaptive concurrency limiting of each of
+// a pool's backends. Unset values use the defaults in adaptive.go.
+type AdaptiveConcurrencyConfig struct {
+	Algorithm        string        `yaml:"algorithm"`
+	InitialLimit     int           `yaml:"initial_limit"`
+	MinLimit         int           `yaml:"min_limit"`
+	MaxLimit         int           `yaml:"max_limit"`
+	Smoothing        float64       `yaml:"smoothing"`
+	Tolerance        float64       `yaml:"tolerance"`
+	BackoffRatio     float64       `yaml:"backoff_ratio"`
+	LatencyThreshold time.Duration `yaml:"latency_threshold"`
+}
+
+// CircuitBreakerConfig puts a circuit breaker in front of each of a pool's
+// backends. Unset values use the defaults in breaker.go.
+type CircuitBreakerConfig struct {
+	Window           time.Duration `yaml:"window"`
+	FailureRate      float64       `yaml:"failure_rate"`
+	MinRequests      int           `yaml:"min_requests"`
+	OpenDuration     time.Duration `yaml:"open_duration"`
+	HalfOpenRequests int           `yaml:"half_open_requests"`
+}
+
+// OutlierConfig enables passive health checking of a pool from live traffic.
+// Unset values use the defaults in outlier.go; latency ejection is off unless
+// latency_factor is set.
+type OutlierConfig struct {
+	Consecutive5xx            int           `yaml:"consecutive_5xx"`
+	ConsecutiveGatewayFailure int           `yaml:"consecutive_gateway_failure"`
+	LatencyFactor             float64       `yaml:"latency_factor"`
+	LatencyMin                time.Duration `yaml:"latency_min"`
+	BaseEjectionTime          time.Duration `yaml:"base_ejection_time"`
+	MaxEjectionTime           time.Duration `yaml:"max_ejection_time"`
+	MaxEjectionPercent        int           `yaml:"max_ejection_percent"`
+}
+
+// HealthCheckConfig controls active health checks for a pool. Unset values
+// default to GET /health expecting 200 within 5s, every
+// health_check_interval, with a single failure or success changing state.
+type HealthCheckConfig struct {
+	Path           string        `yaml:"path"`
+	Method         string        `yaml:"method"`
+	ExpectedStatus []string      `yaml:"expected_status"`
+	BodyContains   string        `yaml:"body_contains"`
+	JSONPath       string        `yaml:"json_path"`
+	JSONValue      string        `yaml:"json_value"`
+	Timeout        time.Duration `yaml:"timeout"`
+	Interval       time.Duration `yaml:"interval"`
+	Jitter         time.Duration `yaml:"jitter"`
+	Rise           int           `yaml:"rise"`
+	Fall           int           `yaml:"fall"`
+}
+
+// StickyConfig enables cookie-based session affinity for a pool
+type StickyConfig struct {
+	Cookie string        `yaml:"cookie"`
+	Secret string        `yaml:"secret"`
+	TTL    time.Duration `yaml:"ttl"`
+}
+
+// BackendConfig is a backend URL with its load balancing weight. In the config
+// file it is either a plain URL or a mapping with url and weight.
+type BackendConfig struct {
+	URL    string
+	Weight int
+}
+
+// UnmarshalYAML accepts both backend forms, defaulting the weight to 1
+func (bc *BackendConfig) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		bc.URL = value.Value
+		bc.Weight = 1
+		return nil
+	}
+
+	if err := checkFields(value, "BackendConfig", "url", "weight"); err != nil {
+		return err
+	}
+	var raw struct {
+		URL    string `yaml:"url"`
+		Weight *int   `yaml:"weight"`
+	}
+	if err := value.Decode(&raw); err != nil {
+		return err
+	}
+
+	bc.URL = raw.URL
+	bc.Weight = 1
+	if raw.Weight != nil {
+		bc.Weight = *raw.Weight
+	}
+	return nil
+}
+
+// RouteConfig sends requests matching all of its conditions to a pool
+type RouteConfig struct {
+	Host        string                  `yaml:"host"`
+	Path        string                  `yaml:"path"`
+	PathPrefix  string                  `yaml:"path_prefix"`
+	PathRegex   string                  `yaml:"path_regex"`
+	Methods     []string                `yaml:"methods"`
+	Headers     map[string]string       `yaml:"headers"`
+	Pool        string                  `yaml:"pool"`
+	Rewrite     *RewriteConfig          `yaml:"rewrite"`
+	Retry       *RetryConfig            `yaml:"retry"`
+	Hedge       *HedgeConfig            `yaml:"hedge"`
+	Timeouts    *TimeoutConfig          `yaml:"timeouts"`
+	Concurrency *ConcurrencyConfig      `yaml:"concurrency"`
+	Priority    int                     `yaml:"priority"`
+	RateLimits  []RateLimitPolicyConfig `yaml:"rate_limits"`
+}
+
+// RateLimitPolicyConfig allows each client requests per window, with bursts
+// of up to burst. Window defaults to 1m, burst to requests and algorithm to
+// token_bucket. Per is "ip" or "key"; requests without an API key are
+// counted by IP. Methods and path_prefix narrow the requests the policy
+// counts.
+type RateLimitPolicyConfig struct {
+	Requests   int           `yaml:"requests"`
+	Window     time.Duration `yaml:"window"`
+	Burst      int           `yaml:"burst"`
+	Algorithm  string        `yaml:"algorithm"`
+	Per        string        `yaml:"per"`
+	Methods    []string      `yaml:"methods"`
+	PathPrefix string        `yaml:"path_prefix"`
+}
+
+// ConcurrencyConfig caps requests in flight to a route, or to each backend
+// of a pool, queueing the excess. Queue defaults to max, and zero rejects
+// the excess without queueing. MaxWait defaults to 1s.
+type ConcurrencyConfig struct {
+	Max     int           `yaml:"max"`
+	Queue   *int          `yaml:"queue"`
+	MaxWait time.Duration `yaml:"max_wait"`
+}
+
+// TimeoutConfig sets upstream timeouts, gateway-wide or for one route.
+// Route values override the gateway-wide ones.
+type TimeoutConfig struct {
+	Connect        time.Duration `yaml:"connect"`
+	ResponseHeader time.Duration `yaml:"response_header"`
+	Total          time.Duration `yaml:"total"`
+	MaxClient      time.Duration `yaml:"max_client"`
+}
+
+// HedgeConfig enables hedged requests on a route. Unset values use the
+// defaults in hedge.go.
+type HedgeConfig struct {
+	Percentile float64       `yaml:"percentile"`
+	MinDelay   time.Duration `yaml:"min_delay"`
+	MaxRate    float64       `yaml:"max_rate"`
+}
+
+// RetryConfig retries a route's failed requests on another backend. Unset
+// values use the defaults in retry.go.
+type RetryConfig struct {
+	Attempts   int           `yaml:"attempts"`
+	OnStatus   []int         `yaml:"on_status"`
+	Methods    []string      `yaml:"methods"`
+	Backoff    time.Duration `yaml:"backoff"`
+	MaxBackoff time.Duration `yaml:"max_backoff"`
+	MaxBody    int64         `yaml:"max_body"`
+}
+
+// RewriteConfig changes the request path and query before proxying. Steps run
+// in field order: strip_prefix, regex/replacement, add_prefix, query.
+type RewriteConfig struct {
+	StripPrefix string            `yaml:"strip_prefix"`
+	Regex       string            `yaml:"regex"`
+	Replacement string            `yaml:"replacement"`
+	AddPrefix   string            `yaml:"add_prefix"`
+	Query       map[string]string `yaml:"query"`
+}
+
+// RateLimitConfig holds the per-minute request limits
+type RateLimitConfig struct {
+	PerIP      int          `yaml:"per_ip"`
+	PerKey     int          `yaml:"per_key"`
+	MaxClients int          `yaml:"max_clients"`
+	Algorithm  string       `yaml:"algorithm"`
+	Redis      *RedisConfig `yaml:"redis"`
+}
+
+// RedisConfig points rate limiting at a Redis server shared by gateway
+// replicas. Prefix defaults to "gateway:ratelimit:" and timeout, which
+// bounds each call, to 50ms.
+type RedisConfig struct {
+	Address  string        `yaml:"address"`
+	Password string        `yaml:"password"`
+	DB       int           `yaml:"db"`
+	Prefix   string        `yaml:"prefix"`
+	Timeout  time.Duration `yaml:"timeout"`
+}
+
+// APIKeyConfig is an API key, its tier and its rate limits. In YAML it is
+// either the key alone, with tier normal, or a mapping. Rate limits replace
+// the gateway-wide per_key limit for the key.
+type APIKeyConfig struct {
+	Key        string                  `yaml:"key"`
+	Tier       string                  `yaml:"tier"`
+	RateLimits []RateLimitPolicyConfig `yaml:"rate_limits"`
+}
+
+// UnmarshalYAML accepts a bare key or a key/tier mapping
+func (kc *APIKeyConfig) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		kc.Key = value.Value
+		return nil
+	}
+
+	if err := checkFields(value, "APIKeyConfig", "key", "tier", "rate_limits"); err != nil {
+		return err
+	}
+	var raw struct {
+		Key        string                  `yaml:"key"`
+		Tier       string                  `yaml:"tier"`
+		RateLimits []RateLimitPolicyConfig `yaml:"rate_limits"`
+	}
+	if err := value.Decode(&raw); err != nil {
+		return err
+	}
+	kc.Key, kc.Tier, kc.RateLimits = raw.Key, raw.Tier, raw.RateLimits
+	return nil
+}
+
+// ShutdownConfig controls connection draining on SIGTERM. DrainDelay
+// defaults to 5s, and zero closes the listener at once.
+type ShutdownConfig struct {
+	DrainDelay   *time.Duration `yaml:"drain_delay"`
+	DrainTimeout time.Duration  `yaml:"drain_timeout"`
+}
+
+// LoadSheddingConfig sets when the gateway counts as overloaded. Zero
+// thresholds are not checked.
+type LoadSheddingConfig struct {
+	CPU        float64 `yaml:"cpu"`
+	QueueDepth int     `yaml:"queue_depth"`
+	InFlight   int     `yaml:"in_flight"`
+}
+
+// RetryBudgetConfig caps retries across all routes
+type RetryBudgetConfig struct {
+	Ratio        float64 `yaml:"ratio"`
+	MinPerSecond int     `yaml:"min_per_second"`
+}
+
+// ConfigError reports an invalid config value along with its source line
+type ConfigError struct {
+	File  string
+	Line  int
+	Field string
+	Msg   string
+}
+
+func (e *ConfigError) Error() string {
+	if e.Line > 0 {
+		return fmt.Sprintf("%s:%d: %s: %s", e.File, e.Line, e.Field, e.Msg)
+	}
+	return fmt.Sprintf("%s: %s: %s", e.File, e.Field, e.Msg)
+}
+
+// DefaultConfig returns the configuration used when no config file is given
+func DefaultConfig() *Config {
+	return &Config{
+		ListenAddr: defaultListenAddr,
+		LogFile:    defaultLogFile,
+		Backends: []BackendConfig{
+			{URL: "http://localhost:8081", Weight: 1},
+			{URL: "http://localhost:8082", Weight: 1},
+		},
+		RateLimitPerIP:          defaultRateLimitPerIP,
+		RateLimitPerKey:         defaultRateLimitPerKey,
+		RateLimitMaxClients:     defaultRateLimitMaxClients,
+		HealthCheckInterval:     defaultHealthCheckInterval,
+		DrainDelay:              defaultDrainDelay,
+		DrainTimeout:            defaultDrainTimeout,
+		RetryBudgetRatio:        defaultRetryBudgetRatio,
+		RetryBudgetMinPerSecond: defaultRetryBudgetMinPerSecond,
+		Timeouts:                TimeoutConfig{Total: defaultTotalTimeout},
+		APIKeys: map[string]Tier{
+			"key-test-1": TierNormal,
+			"key-test-2": TierNormal,
+			"key-admin":  TierCritical,
+		},
+	}
+}
+
+// LoadConfig reads and validates a gateway config file
+func LoadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseConfig(path, data)
+}
+
+// ParseConfig decodes config file contents. Unknown fields are rejected and
+// every error carries the line it refers to.
+func ParseConfig(name string, data []byte) (*Config, error) {
+	var root yaml.Node
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		return nil, yamlError(name, err)
+	}
+
+	var fc FileConfig
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&fc); err != nil && err != io.EOF {
+		return nil, yamlError(name, err)
+	}
+
+	if err := fc.validate(name, &root); err != nil {
+		return nil, err
+	}
+	return fc.toConfig(), nil
+}
+
+// validate checks values that decode cleanly but make no sense
+func (fc *FileConfig) validate(name string, root *yaml.Node) error {
+	fail := func(msg string, path ...string) error {
+		return &ConfigError{
+			File:  name,
+			Line:  nodeLine(root, path...),
+			Field: fieldName(path...),
+			Msg:   msg,
+		}
+	}
+
+	checkBackends := func(backends []BackendConfig, path ...string) error {
+		for i, b := range backends {
+			u, err := url.Parse(b.URL)
+			if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				return fail(fmt.Sprintf("invalid backend URL %q", b.URL), append(path, strconv.Itoa(i))...)
+			}
+			if b.Weight < 0 {
+				return fail("weight must not be negative", append(path, strconv.Itoa(i), "weight")...)
+			}
+		}
+		return nil
+	}
+
+	if len(fc.Backends) == 0 && len(fc.Pools) == 0 {
+		return fail("at least one backend or pool is required", "backends")
+	}
+	if err := checkBackends(fc.Backends, "backends"); err != nil {
+		return err
+	}
+
+	names := make([]string, 0, len(fc.Pools))
+	for name := range fc.Pools {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if name == "" {
+			return fail("pool name must not be empty", "pools")
+		}
+		pool := fc.Pools[name]
+		inherited := name == defaultPool && len(fc.Backends) > 0
+		if inherited && len(pool.Backends) > 0 {
+			return fail(`pool "default" cannot list backends when top-level backends are set`, "pools", name, "backends")
+		}
+		if len(pool.Backends) == 0 && !inherited {
+			return fail("at least one backend is required", "pools", name, "backends")
+		}
+		if pool.Strategy == strategyRingHash {
+			if _, err := parseHashKey(pool.HashKey); err != nil {
+				return fail(err.Error(), "pools", name, "hash_key")
+			}
+			if pool.HashLoadFactor != 0 && pool.HashLoadFactor < 1 {
+				return fail("must be at least 1", "pools", name, "hash_load_factor")
+			}
+		} else if pool.HashKey != "" || pool.HashLoadFactor != 0 {
+			return fail("hash settings require strategy ring_hash", "pools", name, "strategy")
+		}
+		if _, err := newStrategy(pool); err != nil {
+			return fail(err.Error(), "pools", name, "strategy")
+		}
+		if sc := pool.Sticky; sc != nil {
+			if sc.Cookie != "" && strings.ContainsAny(sc.Cookie, " \t;,=\"") {
+				return fail(fmt.Sprintf("invalid cookie name %q", sc.Cookie), "pools", name, "sticky", "cookie")
+			}
+			if sc.TTL < 0 {
+				return fail("must not be negative", "pools", name, "sticky", "ttl")
+			}
+		}
+		if oc := pool.OutlierDetection; oc != nil {
+			if err := oc.validate(func(msg string, path ...string) error {
+				return fail(msg, append([]string{"pools", name, "outlier_detection"}, path...)...)
+			}); err != nil {
+				return err
+			}
+		}
+		if cc := pool.Concurrency; cc != nil {
+			if err := cc.validate(func(msg string, path ...string) error {
+				return fail(msg, append([]string{"pools", name, "concurrency"}, path...)...)
+			}); err != nil {
+				return err
+			}
+		}
+		if ac := pool.Adaptive; ac != nil {
+			if err := ac.validate(func(msg string, path ...string) error {
+				return fail(msg, append([]string{"pools", name, "adaptive_concurrency"}, path...)...)
+			}); err != nil {
+				return err
+			}
+		}
+		if bc := pool.CircuitBreaker; bc != nil {
+			if err := bc.validate(func(msg string, path ...string) error {
+				return fail(msg, append([]string{"pools", name, "circuit_breaker"}, path...)...)
+			}); err != nil {
+				return err
+			}
+		}
+		if hc := pool.HealthCheck; hc != nil {
+			if err := hc.validate(func(msg string, path ...string) error {
+				return fail(msg, append([]string{"pools", name, "health_check"}, path...)...)
+			}); err != nil {
+				return err
+			}
+		}
+		if err := checkBackends(pool.Backends, "pools", name, "backends"); err != nil {
+			return err
+		}
+	}
+
+	if len(fc.Routes) == 0 && len(fc.Backends) == 0 && fc.Pools[defaultPool].Backends == nil {
+		return fail(`no routes defined and no "default" pool to send requests to`, "routes")
+	}
+	for i, route := range fc.Routes {
+		idx := strconv.Itoa(i)
+		set := 0
+		for _, v := range []string{route.Path, route.PathPrefix, route.PathRegex} {
+			if v != "" {
+				set++
+			}
+		}
+		if set > 1 {
+			return fail("only one of path, path_prefix or path_regex may be set", "routes", idx)
+		}
+		if route.Host != "" {
+			host := strings.TrimPrefix(route.Host, "*.")
+			if host == "" || strings.ContainsAny(host, "*/: ") {
+				return fail(fmt.Sprintf("invalid host %q", route.Host), "routes", idx, "host")
+			}
+		}
+		for j, method := range route.Methods {
+			if method == "" || method != strings.ToUpper(method) {
+				return fail(fmt.Sprintf("method %q must be upper case", method), "routes", idx, "methods", strconv.Itoa(j))
+			}
+		}
+		for name := range route.Headers {
+			if name == "" {
+				return fail("header name must not be empty", "routes", idx, "headers")
+			}
+		}
+		if rw := route.Rewrite; rw != nil {
+			if rw.Regex != "" {
+				if _, err := regexp.Compile(rw.Regex); err != nil {
+					return fail(fmt.Sprintf("invalid regex: %v", err), "routes", idx, "rewrite", "regex")
+				}
+			} else if rw.Replacement != "" {
+				return fail("replacement requires regex", "routes", idx, "rewrite", "replacement")
+			}
+			if rw.AddPrefix != "" && !strings.HasPrefix(rw.AddPrefix, "/") {
+				return fail("must start with /", "routes", idx, "rewrite", "add_prefix")
+			}
+		}
+		if rc := route.Retry; rc != nil {
+			if rc.Attempts < 0 {
+				return fail("must not be negative", "routes", idx, "retry", "attempts")
+			}
+			for j, status := range rc.OnStatus {
+				if status < 100 || status > 599 {
+					return fail(fmt.Sprintf("invalid status %d", status), "routes", idx, "retry", "on_status", strconv.Itoa(j))
+				}
+			}
+			for j, method := range rc.Methods {
+				if method == "" || method != strings.ToUpper(method) {
+					return fail(fmt.Sprintf("method %q must be upper case", method), "routes", idx, "retry", "methods", strconv.Itoa(j))
+				}
+			}
+			if rc.Backoff < 0 {
+				return fail("must not be negative", "routes", idx, "retry", "backoff")
+			}
+			if rc.MaxBackoff < 0 {
+				return fail("must not be negative", "routes", idx, "retry", "max_backoff")
+			}
+			if rc.MaxBody < 0 {
+				return fail("must not be negative", "routes", idx, "retry", "max_body")
+			}
+		}
+		if cc := route.Concurrency; cc != nil {
+			if err := cc.validate(func(msg string, path ...string) error {
+				return fail(msg, append([]string{"routes", idx, "concurrency"}, path...)...)
+			}); err != nil {
+				return err
+			}
+		}
+		for j := range route.RateLimits {
+			if err := route.RateLimits[j].validate(func(msg string, path ...string) error {
+				return fail(msg, append([]string{"routes", idx, "rate_limits", strconv.Itoa(j)}, path...)...)
+			}); err != nil {
+				return err
+			}
+		}
+		if tc := route.Timeouts; tc != nil {
+			if err := tc.validate(func(msg string, path ...string) error {
+				return fail(msg, append([]string{"routes", idx, "timeouts"}, path...)...)
+			}); err != nil {
+				return err
+			}
+		}
+		if hc := route.Hedge; hc != nil {
+			if route.Retry != nil {
+				return fail("cannot be combined with retry", "routes", idx, "hedge")
+			}
+			if hc.Percentile < 0 || hc.Percentile >= 100 {
+				return fail("must be between 0 and 100", "routes", idx, "hedge", "percentile")
+			}
+			if hc.MinDelay < 0 {
+				return fail("must not be negative", "routes", idx, "hedge", "min_delay")
+			}
+			if hc.MaxRate < 0 || hc.MaxRate > 1 {
+				return fail("must be between 0 and 1", "routes", idx, "hedge", "max_rate")
+			}
+		}
+		if route.PathRegex != "" {
+			if _, err := regexp.Compile(route.PathRegex); err != nil {
+				return fail(fmt.Sprintf("invalid regex: %v", err), "routes", idx, "path_regex")
+			}
+		}
+		if route.Pool == "" {
+			return fail("pool is required", "routes", idx)
+		}
+		if _, ok := fc.Pools[route.Pool]; !ok && !(route.Pool == defaultPool && len(fc.Backends) > 0) {
+			return fail(fmt.Sprintf("unknown pool %q", route.Pool), "routes", idx, "pool")
+		}
+	}
+
+	if fc.HealthCheckInterval < 0 {
+		return fail("must not be negative", "health_check_interval")
+	}
+	if err := fc.Timeouts.validate(func(msg string, path ...string) error {
+		return fail(msg, append([]string{"timeouts"}, path...)...)
+	}); err != nil {
+		return err
+	}
+	if fc.RetryBudget.Ratio < 0 {
+		return fail("must not be negative", "retry_budget", "ratio")
+	}
+	if fc.RetryBudget.MinPerSecond < 0 {
+		return fail("must not be negative", "retry_budget", "min_per_second")
+	}
+	if fc.RateLimit.PerIP < 0 {
+		return fail("must not be negative", "rate_limit", "per_ip")
+	}
+	if fc.RateLimit.PerKey < 0 {
+		return fail("must not be negative", "rate_limit", "per_key")
+	}
+	if fc.RateLimit.MaxClients < 0 {
+		return fail("must not be negative", "rate_limit", "max_clients")
+	}
+	if err := checkAlgorithm(fc.RateLimit.Algorithm); err != nil {
+		return fail(err.Error(), "rate_limit", "algorithm")
+	}
+	if rc := fc.RateLimit.Redis; rc != nil {
+		if rc.Address == "" {
+			return fail("address is required", "rate_limit", "redis")
+		}
+		if _, _, err := net.SplitHostPort(rc.Address); err != nil {
+			return fail(fmt.Sprintf("invalid address %q: want host:port", rc.Address), "rate_limit", "redis", "address")
+		}
+		if rc.DB < 0 {
+			return fail("must not be negative", "rate_limit", "redis", "db")
+		}
+		if rc.Timeout < 0 {
+			return fail("must not be negative", "rate_limit", "redis", "timeout")
+		}
+	}
+
+	seen := make(map[string]bool)
+	for i, kc := range fc.APIKeys {
+		idx := strconv.Itoa(i)
+		if kc.Key == "" {
+			return fail("API key must not be empty", "api_keys", idx)
+		}
+		if seen[kc.Key] {
+			return fail(fmt.Sprintf("duplicate API key %q", kc.Key), "api_keys", idx)
+		}
+		seen[kc.Key] = true
+		if kc.Tier != "" {
+			if _, err := parseTier(kc.Tier); err != nil {
+				return fail(err.Error(), "api_keys", idx, "tier")
+			}
+		}
+		for j := range kc.RateLimits {
+			pc := &kc.RateLimits[j]
+			if pc.Per != "" && pc.Per != "key" {
+				return fail(`must be "key"`, "api_keys", idx, "rate_limits", strconv.Itoa(j), "per")
+			}
+			if err := pc.validate(func(msg string, path ...string) error {
+				return fail(msg, append([]string{"api_keys", idx, "rate_limits", strconv.Itoa(j)}, path...)...)
+			}); err != nil {
+				return err
+			}
+		}
+	}
+
+	if fc.Shutdown.DrainDelay != nil && *fc.Shutdown.DrainDelay < 0 {
+		return fail("must not be negative", "shutdown", "drain_delay")
+	}
+	if fc.Shutdown.DrainTimeout < 0 {
+		return fail("must not be negative", "shutdown", "drain_timeout")
+	}
+
+	if lc := fc.LoadShedding; lc != nil {
+		if lc.CPU < 0 || lc.CPU > 1 {
+			return fail("must be between 0 and 1", "load_shedding", "cpu")
+		}
+		if lc.QueueDepth < 0 {
+			return fail("must not be negative", "load_shedding", "queue_depth")
+		}
+		if lc.InFlight < 0 {
+			return fail("must not be negative", "load_shedding", "in_flight")
+		}
+	}
+
+	return nil
+}
+
+// validate checks a pool's health check settings, reporting errors through
+// fail with the path of the offending field
+func (hc *HealthCheckConfig) validate(fail func(msg string, path ...string) error) error {
+	if hc.Path != "" && !strings.HasPrefix(hc.Path, "/") {
+		return fail("must start with /", "path")
+	}
+	if hc.Method != "" && hc.Method != strings.ToUpper(hc.Method) {
+		return fail(fmt.Sprintf("method %q must be upper case", hc.Method), "method")
+	}
+	for i, s := range hc.ExpectedStatus {
+		if _, err := parseStatusRange(s); err != nil {
+			return fail(err.Error(), "expected_status", strconv.Itoa(i))
+		}
+	}
+	if hc.JSONValue != "" && hc.JSONPath == "" {
+		return fail("json_value requires json_path", "json_value")
+	}
+	if hc.Timeout < 0 {
+		return fail("must not be negative", "timeout")
+	}
+	if hc.Interval < 0 {
+		return fail("must not be negative", "interval")
+	}
+	if hc.Jitter < 0 {
+		return fail("must not be negative", "jitter")
+	}
+	if hc.Rise < 0 {
+		return fail("must not be negative", "rise")
+	}
+	if hc.Fall < 0 {
+		return fail("must not be negative", "fall")
+	}
+	return nil
+}
+
+// validate checks a pool's outlier detection settings
+func (oc *OutlierConfig) validate(fail func(msg string, path ...string) error) error {
+	if oc.Consecutive5xx < 0 {
+		return fail("must not be negative", "consecutive_5xx")
+	}
+	if oc.ConsecutiveGatewayFailure < 0 {
+		return fail("must not be negative", "consecutive_gateway_failure")
+	}
+	if oc.LatencyFactor != 0 && oc.LatencyFactor <= 1 {
+		return fail("must be greater than 1", "latency_factor")
+	}
+	if oc.LatencyMin < 0 {
+		return fail("must not be negative", "latency_min")
+	}
+	if oc.BaseEjectionTime < 0 {
+		return fail("must not be negative", "base_ejection_time")
+	}
+	if oc.MaxEjectionTime < 0 {
+		return fail("must not be negative", "max_ejection_time")
+	}
+	if oc.MaxEjectionPercent < 0 || oc.MaxEjectionPercent > 100 {
+		return fail("must be between 0 and 100", "max_ejection_percent")
+	}
+	return nil
+}
+
+// validate checks a route or pool concurrency limit
+func (cc *ConcurrencyConfig) validate(fail func(msg string, path ...string) error) error {
+	if cc.Max < 0 {
+		return fail("must not be negative", "max")
+	}
+	if cc.Queue != nil && *cc.Queue < 0 {
+		return fail("must not be negative", "queue")
+	}
+	if cc.MaxWait < 0 {
+		return fail("must not be negative", "max_wait")
+	}
+	return nil
+}
+
+// validate checks a pool's adaptive concurrency settings
+func (ac *AdaptiveConcurrencyConfig) validate(fail func(msg string, path ...string) error) error {
+	switch ac.Algorithm {
+	case "", adaptiveGradient, adaptiveAIMD:
+	default:
+		return fail(fmt.Sprintf("unknown algorithm %q (want %s or %s)", ac.Algorithm, adaptiveGradient, adaptiveAIMD), "algorithm")
+	}
+	if ac.InitialLimit < 0 {
+		return fail("must not be negative", "initial_limit")
+	}
+	if ac.MinLimit < 0 {
+		return fail("must not be negative", "min_limit")
+	}
+	if ac.MaxLimit < 0 {
+		return fail("must not be negative", "max_limit")
+	}
+	if ac.MaxLimit > 0 && ac.MinLimit > ac.MaxLimit {
+		return fail("must not exceed max_limit", "min_limit")
+	}
+	if ac.Smoothing < 0 || ac.Smoothing > 1 {
+		return fail("must be between 0 and 1", "smoothing")
+	}
+	if ac.Tolerance != 0 && ac.Tolerance < 1 {
+		return fail("must be at least 1", "tolerance")
+	}
+	if ac.BackoffRatio < 0 || ac.BackoffRatio >= 1 {
+		return fail("must be between 0 and 1", "backoff_ratio")
+	}
+	if ac.LatencyThreshold < 0 {
+		return fail("must not be negative", "latency_threshold")
+	}
+	return nil
+}
+
+// validate checks a route or API key rate limit policy
+func (pc *RateLimitPolicyConfig) validate(fail func(msg string, path ...string) error) error {
+	if pc.Requests <= 0 {
+		return fail("must be positive", "requests")
+	}
+	if pc.Window != 0 && pc.Window < time.Second {
+		return fail("must be at least 1s", "window")
+	}
+	if pc.Burst < 0 {
+		return fail("must not be negative", "burst")
+	}
+	if err := checkAlgorithm(pc.Algorithm); err != nil {
+		return fail(err.Error(), "algorithm")
+	}
+	if pc.Burst != 0 && (pc.Algorithm == algorithmSlidingWindow || pc.Algorithm == algorithmSlidingLog) {
+		return fail("only applies to token_bucket and gcra", "burst")
+	}
+	if pc.Per != "" && pc.Per != "ip" && pc.Per != "key" {
+		return fail(`must be "ip" or "key"`, "per")
+	}
+	for j, method := range pc.Methods {
+		if method != strings.ToUpper(method) {
+			return fail(fmt.Sprintf("method %q must be upper case", method), "methods", strconv.Itoa(j))
+		}
+	}
+	if pc.PathPrefix != "" && !strings.HasPrefix(pc.PathPrefix, "/") {
+		return fail("must start with /", "path_prefix")
+	}
+	return nil
+}
+
+// validate checks gateway-wide or route timeouts
+func (tc *TimeoutConfig) validate(fail func(msg string, path ...string) error) error {
+	if tc.Connect < 0 {
+		return fail("must not be negative", "connect")
+	}
+	if tc.ResponseHeader < 0 {
+		return fail("must not be negative", "response_header")
+	}
+	if tc.Total < 0 {
+		return fail("must not be negative", "total")
+	}
+	if tc.MaxClient < 0 {
+		return fail("must not be negative", "max_client")
+	}
+	return nil
+}
+
+// validate checks a pool's circuit breaker settings
+func (bc *CircuitBreakerConfig) validate(fail func(msg string, path ...string) error) error {
+	if bc.Window < 0 || (bc.Window > 0 && bc.Window < breakerBuckets*time.Millisecond) {
+		return fail(fmt.Sprintf("must be at least %dms", breakerBuckets), "window")
+	}
+	if bc.FailureRate < 0 || bc.FailureRate > 1 {
+		return fail("must be between 0 and 1", "failure_rate")
+	}
+	if bc.MinRequests < 0 {
+		return fail("must not be negative", "min_requests")
+	}
+	if bc.OpenDuration < 0 {
+		return fail("must not be negative", "open_duration")
+	}
+	if bc.HalfOpenRequests < 0 {
+		return fail("must not be negative", "half_open_requests")
+	}
+	return nil
+}
+
+// toConfig converts a validated file config to the runtime Config,
+// filling unset values with defaults
+func (fc *FileConfig) toConfig() *Config {
+	config := &Config{
+		ListenAddr:              fc.Listen,
+		LogFile:                 fc.LogFile,
+		Backends:                fc.Backends,
+		RateLimitPerIP:          fc.RateLimit.PerIP,
+		RateLimitPerKey:         fc.RateLimit.PerKey,
+		RateLimitMaxClients:     fc.RateLimit.MaxClients,
+		RateLimitAlgorithm:      fc.RateLimit.Algorithm,
+		RateLimitRedis:          fc.RateLimit.Redis,
+		HealthCheckInterval:     fc.HealthCheckInterval,
+		DrainDelay:              defaultDrainDelay,
+		DrainTimeout:            fc.Shutdown.DrainTimeout,
+		RetryBudgetRatio:        fc.RetryBudget.Ratio,
+		RetryBudgetMinPerSecond: fc.RetryBudget.MinPerSecond,
+		Timeouts:                fc.Timeouts,
+		APIKeys:                 make(map[string]Tier),
+		KeyRateLimits:           make(map[string][]*RateLimitPolicy),
+		LoadShedding:            fc.LoadShedding,
+		Pools:                   fc.Pools,
+		Routes:                  fc.Routes,
+	}
+
+	if config.ListenAddr == "" {
+		config.ListenAddr = defaultListenAddr
+	}
+	if config.LogFile == "" {
+		config.LogFile = defaultLogFile
+	}
+	if config.RateLimitPerIP == 0 {
+		config.RateLimitPerIP = defaultRateLimitPerIP
+	}
+	if config.RateLimitPerKey == 0 {
+		config.RateLimitPerKey = defaultRateLimitPerKey
+	}
+	if config.RateLimitMaxClients == 0 {
+		config.RateLimitMaxClients = defaultRateLimitMaxClients
+	}
+	if rc := config.RateLimitRedis; rc != nil {
+		if rc.Prefix == "" {
+			rc.Prefix = defaultRedisPrefix
+		}
+		if rc.Timeout == 0 {
+			rc.Timeout = defaultRedisTimeout
+		}
+	}
+	if config.HealthCheckInterval == 0 {
+		config.HealthCheckInterval = defaultHealthCheckInterval
+	}
+	if fc.Shutdown.DrainDelay != nil {
+		config.DrainDelay = *fc.Shutdown.DrainDelay
+	}
+	if config.DrainTimeout == 0 {
+		config.DrainTimeout = defaultDrainTimeout
+	}
+	if config.Timeouts.Total == 0 {
+		config.Timeouts.Total = defaultTotalTimeout
+	}
+	if config.RetryBudgetRatio == 0 {
+		config.RetryBudgetRatio = defaultRetryBudgetRatio
+	}
+	if config.RetryBudgetMinPerSecond == 0 {
+		config.RetryBudgetMinPerSecond = defaultRetryBudgetMinPerSecond
+	}
+	for _, kc := range fc.APIKeys {
+		tier := TierNormal
+		if kc.Tier != "" {
+			tier, _ = parseTier(kc.Tier)
+		}
+		config.APIKeys[kc.Key] = tier
+		if len(kc.RateLimits) > 0 {
+			policies := make([]*RateLimitPolicy, len(kc.RateLimits))
+			for j, id := range policyIDs("key "+kc.Key, kc.RateLimits) {
+				pc := kc.RateLimits[j]
+				pc.Per = "key"
+				policies[j] = newRateLimitPolicy(id, "api key", pc)
+			}
+			config.KeyRateLimits[kc.Key] = policies
+		}
+	}
+	if fc.NotFound != nil {
+		config.NotFoundBody, _ = json.Marshal(fc.NotFound)
+	}
+
+	return config
+}
+
+// yamlError rewrites decoder errors ("yaml: line 3: ...") as "file:3: ..."
+func yamlError(name string, err error) error {
+	var msgs []string
+	if te, ok := err.(*yaml.TypeError); ok {
+		msgs = te.Errors
+	} else {
+		msgs = []string{strings.TrimPrefix(err.Error(), "yaml: ")}
+	}
+
+	for i, msg := range msgs {
+		var line int
+		if n, _ := fmt.Sscanf(msg, "line %d:", &line); n == 1 {
+			msgs[i] = fmt.Sprintf("%s:%d:%s", name, line, strings.SplitN(msg, ":", 2)[1])
+		} else {
+			msgs[i] = fmt.Sprintf("%s: %s", name, msg)
+		}
+	}
+	return errors.New(strings.Join(msgs, "\n"))
+}
+
+// checkFields rejects mapping keys other than fields, for types that decode
+// themselves and so bypass the decoder's unknown field check
+func checkFields(node *yaml.Node, typeName string, fields ...string) error {
+	if node.Kind != yaml.MappingNode {
+		return nil
+	}
+
+	var errs []string
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key := node.Content[i]
+		known := false
+		for _, f := range fields {
+			if key.Value == f {
+				known = true
+				break
+			}
+		}
+		if !known {
+			errs = append(errs, fmt.Sprintf("line %d: field %s not found in type main.%s", key.Line, key.Value, typeName))
+		}
+	}
+
+	if len(errs) > 0 {
+		return &yaml.TypeError{Errors: errs}
+	}
+	return nil
+}
+
+// nodeLine finds the line of the value at path (mapping keys or sequence
+// indexes). It falls back to the deepest node found.
+func nodeLine(root *yaml.Node, path ...string) int {
+	node := root
+	if node.Kind == yaml.DocumentNode && len(node.Content) > 0 {
+		node = node.Content[0]
+	}
+	line := node.Line
+
+	for _, p := range path {
+		var next *yaml.Node
+		switch node.Kind {
+		case yaml.MappingNode:
+			for i := 0; i+1 < len(node.Content); i += 2 {
+				if node.Content[i].Value == p {
+					next = node.Content[i+1]
+					break
+				}
+			}
+		case yaml.SequenceNode:
+			if idx, err := strconv.Atoi(p); err == nil && idx < len(node.Content) {
+				next = node.Content[idx]
+			}
+		}
+		if next == nil {
+			break
+		}
+		node = next
+		line = node.Line
+	}
+
+	return line
+}
+
+// fieldName renders a config path like rate_limit.per_ip or backends[1]
+func fieldName(path ...string) string {
+	var sb strings.Builder
+	for _, p := range path {
+		if _, err := strconv.Atoi(p); err == nil {
+			sb.WriteString("[" + p + "]")
+			continue
+		}
+		if sb.Len() > 0 {
+			sb.WriteString(".")
+		}
+		sb.WriteString(p)
+	}
+	return sb.String()
+}
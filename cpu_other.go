@@ -0,0 +1,11 @@
+//go:build !unix
+
+package main
+
+import "time"
+
+// processCPUTime is not available on this platform, so load shedding only
+// uses queue depth and in-flight requests
+func processCPUTime() (time.Duration, bool) {
+	return 0, false
+}
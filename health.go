@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Health check defaults, matching the gateway's original behavior
+const (
+	defaultHealthCheckPath    = "/health"
+	defaultHealthCheckTimeout = 5 * time.Second
+
+	// healthCheckBodyLimit caps how much of a response is read for body and
+	// JSON checks
+	healthCheckBodyLimit = 64 << 10
+
+	// healthCheckTick is how often the health check loop looks for due checks
+	healthCheckTick = 250 * time.Millisecond
+)
+
+// HealthCheck describes how a pool probes its backends
+type HealthCheck struct {
+	Path         string
+	Method       string
+	Statuses     []statusRange
+	BodyContains string
+	JSONPath     []string
+	JSONValue    string
+	Timeout      time.Duration
+	Interval     time.Duration
+	Jitter       time.Duration
+	Rise         int
+	Fall         int
+}
+
+// statusRange is an inclusive range of HTTP status codes
+type statusRange struct {
+	lo, hi int
+}
+
+// newHealthCheck builds a pool's health check from its config, which may be
+// nil. Unset fields use the defaults and defaultInterval.
+func newHealthCheck(hc *HealthCheckConfig, defaultInterval time.Duration) (*HealthCheck, error) {
+	check := &HealthCheck{
+		Path:     defaultHealthCheckPath,
+		Method:   http.MethodGet,
+		Statuses: []statusRange{{http.StatusOK, http.StatusOK}},
+		Timeout:  defaultHealthCheckTimeout,
+		Interval: defaultInterval,
+		Rise:     1,
+		Fall:     1,
+	}
+	if hc == nil {
+		return check, nil
+	}
+
+	if hc.Path != "" {
+		check.Path = hc.Path
+	}
+	if hc.Method != "" {
+		check.Method = hc.Method
+	}
+	if len(hc.ExpectedStatus) > 0 {
+		check.Statuses = nil
+		for _, s := range hc.ExpectedStatus {
+			sr, err := parseStatusRange(s)
+			if err != nil {
+				return nil, err
+			}
+			check.Statuses = append(check.Statuses, sr)
+		}
+	}
+	check.BodyContains = hc.BodyContains
+	if hc.JSONPath != "" {
+		check.JSONPath = strings.Split(hc.JSONPath, ".")
+		check.JSONValue = hc.JSONValue
+	}
+	if hc.Timeout > 0 {
+		check.Timeout = hc.Timeout
+	}
+	if hc.Interval > 0 {
+		check.Interval = hc.Interval
+	}
+	check.Jitter = hc.Jitter
+	if hc.Rise > 0 {
+		check.Rise = hc.Rise
+	}
+	if hc.Fall > 0 {
+		check.Fall = hc.Fall
+	}
+
+	return check, nil
+}
+
+// parseStatusRange parses "200" or "200-299"
+func parseStatusRange(s string) (statusRange, error) {
+	loStr, hiStr, isRange := strings.Cut(s, "-")
+	lo, err1 := strconv.Atoi(strings.TrimSpace(loStr))
+	hi := lo
+	var err2 error
+	if isRange {
+		hi, err2 = strconv.Atoi(strings.TrimSpace(hiStr))
+	}
+	if err1 != nil || err2 != nil || lo < 100 || hi > 599 || lo > hi {
+		return statusRange{}, fmt.Errorf("invalid status %q (want a code like 200 or a range like 200-299)", s)
+	}
+	return statusRange{lo, hi}, nil
+}
+
+// HealthCheck.next returns when the check after one starting now is due
+func (hc *HealthCheck) next(now time.Time) time.Time {
+	next := now.Add(hc.Interval)
+	if hc.Jitter > 0 {
+		next = next.Add(time.Duration(rand.Int63n(int64(hc.Jitter))))
+	}
+	return next
+}
+
+// HealthCheck.probe checks one backend, returning why it is unhealthy
+func (hc *HealthCheck) probe(backend *Backend) error {
+	ctx, cancel := context.WithTimeout(context.Background(), hc.Timeout)
+	defer cancel()
+
+	healthURL := strings.TrimSuffix(backend.URL.String(), "/") + hc.Path
+	req, err := http.NewRequestWithContext(ctx, hc.Method, healthURL, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if !hc.statusOK(resp.StatusCode) {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	if hc.BodyContains == "" && hc.JSONPath == nil {
+		return nil
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, healthCheckBodyLimit))
+	if err != nil {
+		return err
+	}
+	if hc.BodyContains != "" && !strings.Contains(string(body), hc.BodyContains) {
+		return fmt.Errorf("body does not contain %q", hc.BodyContains)
+	}
+	if hc.JSONPath != nil {
+		return hc.checkJSON(body)
+	}
+	return nil
+}
+
+func (hc *HealthCheck) statusOK(code int) bool {
+	for _, sr := range hc.Statuses {
+		if code >= sr.lo && code <= sr.hi {
+			return true
+		}
+	}
+	return false
+}
+
+// checkJSON requires the dotted JSONPath to exist in body and, if JSONValue
+// is set, to equal it
+func (hc *HealthCheck) checkJSON(body []byte) error {
+	var v interface{}
+	if err := json.Unmarshal(body, &v); err != nil {
+		return fmt.Errorf("invalid JSON body: %v", err)
+	}
+
+	path := strings.Join(hc.JSONPath, ".")
+	for _, key := range hc.JSONPath {
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("JSON path %s not found", path)
+		}
+		if v, ok = obj[key]; !ok {
+			return fmt.Errorf("JSON path %s not found", path)
+		}
+	}
+
+	if hc.JSONValue != "" && fmt.Sprint(v) != hc.JSONValue {
+		return fmt.Errorf("JSON path %s is %v, want %s", path, v, hc.JSONValue)
+	}
+	return nil
+}
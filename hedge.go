@@ -0,0 +1,257 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Hedging defaults, used for fields left unset
+const (
+	defaultHedgePercentile = 95
+	defaultHedgeMinDelay   = 10 * time.Millisecond
+	defaultHedgeMaxRate    = 0.1
+
+	// hedgeSamples is how many recent latencies the hedge delay is computed
+	// from; hedging starts once hedgeMinSamples have been seen
+	hedgeSamples    = 512
+	hedgeMinSamples = 20
+
+	// hedgeRecompute is how many new samples trigger recomputing the delay
+	hedgeRecompute = 32
+)
+
+// HedgePolicy sends a second copy of a slow read-only request to another
+// backend once the first has taken longer than the route's Percentile
+// latency. Whichever responds first is used and the other is cancelled.
+// MaxRate caps the share of requests that are hedged.
+type HedgePolicy struct {
+	Percentile float64
+	MinDelay   time.Duration
+	MaxRate    float64
+
+	budget  *RetryBudget
+	latency latencyTracker
+}
+
+// latencyTracker keeps a route's recent latencies and their percentile
+type latencyTracker struct {
+	samples [hedgeSamples]time.Duration
+	count   int
+	pending int
+	delay   time.Duration
+	mu      sync.Mutex
+}
+
+// hedgeRace lets the first response of a hedged request through and holds
+// back the rest. A transport error only wins if no other attempt is
+// still running.
+type hedgeRace struct {
+	winner  int
+	pending int
+	mu      sync.Mutex
+}
+
+// hedgeOutcome is the result of one attempt of a hedged request
+type hedgeOutcome struct {
+	attempt int
+	backend *Backend
+	result  ProxyResult
+}
+
+// newHedgePolicy builds a route's hedge policy from its config. It returns
+// nil when the route has none configured.
+func newHedgePolicy(hc *HedgeConfig) *HedgePolicy {
+	if hc == nil {
+		return nil
+	}
+
+	hp := &HedgePolicy{
+		Percentile: hc.Percentile,
+		MinDelay:   hc.MinDelay,
+		MaxRate:    hc.MaxRate,
+	}
+	if hp.Percentile == 0 {
+		hp.Percentile = defaultHedgePercentile
+	}
+	if hp.MinDelay == 0 {
+		hp.MinDelay = defaultHedgeMinDelay
+	}
+	if hp.MaxRate == 0 {
+		hp.MaxRate = defaultHedgeMaxRate
+	}
+	hp.budget = &RetryBudget{Ratio: hp.MaxRate}
+	return hp
+}
+
+// HedgePolicy.eligible reports whether r may be hedged: read-only, without
+// a body and not asking to upgrade the connection, which only one attempt
+// could take over
+func (hp *HedgePolicy) eligible(r *http.Request) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	for _, v := range r.Header.Values("Connection") {
+		for _, token := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return false
+			}
+		}
+	}
+	return r.Body == nil || r.Body == http.NoBody
+}
+
+// HedgePolicy.Forward proxies r to first, hedging to another backend from
+// pool if first is slow. It returns the winning attempt's result, backend
+// and number (1 for the original request, 2 for the hedge), and how many
+// attempts were sent.
+func (hp *HedgePolicy) Forward(pool *Pool, first *Backend, w http.ResponseWriter, r *http.Request) (hedgeOutcome, int) {
+	hp.budget.Request()
+
+	race := &hedgeRace{}
+	outcomes := make(chan hedgeOutcome, 2)
+	cancels := make([]context.CancelFunc, 0, 2)
+	defer func() {
+		for _, cancel := range cancels {
+			cancel()
+		}
+	}()
+
+	send := func(attempt int, backend *Backend) {
+		ctx, cancel := context.WithCancel(r.Context())
+		cancels = append(cancels, cancel)
+		race.start()
+		go func() {
+			result := backend.Forward(w, r.WithContext(ctx), func(status int, err error) bool {
+				return !race.claim(attempt, err)
+			})
+			outcomes <- hedgeOutcome{attempt: attempt, backend: backend, result: result}
+		}()
+	}
+
+	send(1, first)
+
+	delay, ok := hp.latency.percentile(hp.Percentile)
+	if !ok {
+		return hp.finish(pool, outcomes), 1
+	}
+	if delay < hp.MinDelay {
+		delay = hp.MinDelay
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case o := <-outcomes:
+		hp.observe(pool, o)
+		return o, 1
+	case <-timer.C:
+	}
+
+	// Check the budget first, since picking a backend may take a half-open
+	// breaker's trial
+	if !hp.budget.Withdraw() {
+		return hp.finish(pool, outcomes), 1
+	}
+	second := pool.LB.NextExcept(r, map[*Backend]bool{first: true})
+	if second == nil {
+		return hp.finish(pool, outcomes), 1
+	}
+	send(2, second)
+
+	// Take the first response and cancel the other attempt
+	var winner hedgeOutcome
+	for i := 0; i < 2; i++ {
+		o := <-outcomes
+		if !o.result.Held {
+			winner = o
+			for _, cancel := range cancels {
+				cancel()
+			}
+		}
+		// A cancelled loser only gives back any breaker trial it took
+		hp.observe(pool, o)
+	}
+	return winner, 2
+}
+
+// finish waits for the only attempt of a request that was not hedged
+func (hp *HedgePolicy) finish(pool *Pool, outcomes chan hedgeOutcome) hedgeOutcome {
+	o := <-outcomes
+	hp.observe(pool, o)
+	return o
+}
+
+// observe records an attempt's outcome with the pool and, for responses
+// that were used, the route's latency
+func (hp *HedgePolicy) observe(pool *Pool, o hedgeOutcome) {
+	pool.Observe(o.backend, o.result)
+	if !o.result.Held {
+		hp.latency.add(o.result.Latency)
+	}
+}
+
+func (lt *latencyTracker) add(d time.Duration) {
+	lt.mu.Lock()
+	defer lt.mu.Unlock()
+
+	lt.samples[lt.count%hedgeSamples] = d
+	lt.count++
+	lt.pending++
+}
+
+// percentile returns the p-th percentile of recent latencies, recomputed
+// every hedgeRecompute samples. It reports false until enough samples have
+// been seen.
+func (lt *latencyTracker) percentile(p float64) (time.Duration, bool) {
+	lt.mu.Lock()
+	defer lt.mu.Unlock()
+
+	if lt.count < hedgeMinSamples {
+		return 0, false
+	}
+	if lt.delay == 0 || lt.pending >= hedgeRecompute {
+		n := lt.count
+		if n > hedgeSamples {
+			n = hedgeSamples
+		}
+		sorted := make([]time.Duration, n)
+		copy(sorted, lt.samples[:n])
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+		idx := int(p / 100 * float64(n))
+		if idx >= n {
+			idx = n - 1
+		}
+		lt.delay = sorted[idx]
+		lt.pending = 0
+	}
+	return lt.delay, true
+}
+
+// start counts an attempt that has been sent
+func (hr *hedgeRace) start() {
+	hr.mu.Lock()
+	defer hr.mu.Unlock()
+	hr.pending++
+}
+
+// claim reports whether the attempt's response should be sent to the client
+func (hr *hedgeRace) claim(attempt int, err error) bool {
+	hr.mu.Lock()
+	defer hr.mu.Unlock()
+
+	if hr.winner != 0 {
+		return hr.winner == attempt
+	}
+	if err != nil && hr.pending > 1 {
+		hr.pending--
+		return false
+	}
+	hr.winner = attempt
+	return true
+}
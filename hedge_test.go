@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// TestHedgeWithRetryRejected checks that a route cannot configure both
+func TestHedgeWithRetryRejected(t *testing.T) {
+	_, err := ParseConfig("test.yaml", []byte(`
+backends: [http://localhost:8081]
+routes:
+  - path: /api/data
+    retry:
+      attempts: 2
+    hedge:
+      min_delay: 10ms
+`))
+	if err == nil {
+		t.Fatal("hedge with retry accepted")
+	}
+	if !strings.Contains(err.Error(), "test.yaml:8") || !strings.Contains(err.Error(), "retry") {
+		t.Errorf("error = %v, want one naming retry at line 8", err)
+	}
+}
+
+// TestHedgeEligible covers the requests that may be hedged
+func TestHedgeEligible(t *testing.T) {
+	tests := []struct {
+		method     string
+		connection string
+		body       string
+		want       bool
+	}{
+		{"GET", "", "", true},
+		{"HEAD", "", "", true},
+		{"GET", "keep-alive", "", true},
+		{"GET", "Upgrade", "", false},
+		{"GET", "keep-alive, upgrade", "", false},
+		{"POST", "", "", false},
+		{"GET", "", "data", false},
+	}
+	hp := newHedgePolicy(&HedgeConfig{})
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, "/", nil)
+		if tt.body != "" {
+			r = httptest.NewRequest(tt.method, "/", strings.NewReader(tt.body))
+		}
+		if tt.connection != "" {
+			r.Header.Set("Connection", tt.connection)
+		}
+		if got := hp.eligible(r); got != tt.want {
+			t.Errorf("%s with Connection %q, body %q: eligible = %v, want %v",
+				tt.method, tt.connection, tt.body, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// Rate limiting algorithm names used in rate limit policies
+const (
+	algorithmTokenBucket   = "token_bucket"
+	algorithmSlidingWindow = "sliding_window"
+	algorithmSlidingLog    = "sliding_log"
+	algorithmGCRA          = "gcra"
+)
+
+// Limiter is one client's state under a rate limiting algorithm. Methods are
+// called with the store shard's lock held and are given the time rather than
+// reading the clock, so algorithms can be driven by a synthetic clock.
+type Limiter interface {
+	// Take admits a request at now if the client has quota left under p.
+	// It fills in everything but the result's scope and policy.
+	Take(p *RateLimitPolicy, now time.Time) RateLimitResult
+	// Idle reports whether the state is no different from a new client's
+	Idle(now time.Time) bool
+}
+
+// newLimiter returns a new client's state for p's algorithm
+func newLimiter(p *RateLimitPolicy, now time.Time) Limiter {
+	switch p.Algorithm {
+	case algorithmSlidingWindow:
+		return &slidingWindow{}
+	case algorithmSlidingLog:
+		return &slidingLog{}
+	case algorithmGCRA:
+		return &gcra{}
+	}
+	return &TokenBucket{
+		tokens:     float64(p.Burst),
+		capacity:   float64(p.Burst),
+		refillRate: p.rate(),
+		lastRefill: now,
+	}
+}
+
+// checkAlgorithm validates a rate limiting algorithm name
+func checkAlgorithm(name string) error {
+	switch name {
+	case "", algorithmTokenBucket, algorithmSlidingWindow, algorithmSlidingLog, algorithmGCRA:
+		return nil
+	}
+	return fmt.Errorf("unknown algorithm %q (want %s, %s, %s or %s)",
+		name, algorithmTokenBucket, algorithmSlidingWindow, algorithmSlidingLog, algorithmGCRA)
+}
+
+// TokenBucket refills at the policy's sustained rate up to its burst. A
+// client that has been idle can spend the whole burst at once.
+type TokenBucket struct {
+	tokens     float64
+	capacity   float64
+	refillRate float64
+	lastRefill time.Time
+}
+
+func (tb *TokenBucket) Take(p *RateLimitPolicy, now time.Time) RateLimitResult {
+	tb.resize(p, now)
+	tb.refill(now)
+	allowed := tb.tokens >= 1
+	if allowed {
+		tb.tokens--
+	}
+	return tb.result(p, allowed)
+}
+
+// TokenBucket.result describes the bucket after a request was admitted or
+// rejected
+func (tb *TokenBucket) result(p *RateLimitPolicy, allowed bool) RateLimitResult {
+	result := RateLimitResult{
+		Allowed:   allowed,
+		Limit:     p.Burst,
+		Remaining: int(tb.tokens),
+		Reset:     tb.until(tb.capacity),
+	}
+	if !allowed {
+		result.RetryAfter = tb.until(1)
+	}
+	return result
+}
+
+// TokenBucket.Idle reports whether the bucket has refilled completely
+func (tb *TokenBucket) Idle(now time.Time) bool {
+	return tb.tokens+now.Sub(tb.lastRefill).Seconds()*tb.refillRate >= tb.capacity
+}
+
+// TokenBucket.refill adds tokens based on time elapsed
+func (tb *TokenBucket) refill(now time.Time) {
+	elapsed := now.Sub(tb.lastRefill).Seconds()
+	tb.tokens = min(tb.capacity, tb.tokens+elapsed*tb.refillRate)
+	tb.lastRefill = now
+}
+
+// TokenBucket.until returns how long until the bucket holds tokens
+func (tb *TokenBucket) until(tokens float64) time.Duration {
+	if tb.tokens >= tokens {
+		return 0
+	}
+	return time.Duration((tokens - tb.tokens) / tb.refillRate * float64(time.Second))
+}
+
+// TokenBucket.resize applies a changed burst or rate, keeping the tokens the
+// client has already used
+func (tb *TokenBucket) resize(p *RateLimitPolicy, now time.Time) {
+	if tb.capacity == float64(p.Burst) && tb.refillRate == p.rate() {
+		return
+	}
+	tb.refill(now)
+	tb.capacity = float64(p.Burst)
+	tb.refillRate = p.rate()
+	tb.tokens = min(tb.tokens, tb.capacity)
+}
+
+func min(a, b float64) float64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// slidingWindow is the sliding window counter: requests are counted in fixed
+// windows, and the previous window's count is weighted by how much of it
+// still overlaps the sliding window ending now. It never allows more than
+// the policy's requests in any window and needs no burst.
+type slidingWindow struct {
+	start  time.Time // start of the current fixed window
+	window time.Duration
+	prev   int
+	curr   int
+}
+
+func (sw *slidingWindow) Take(p *RateLimitPolicy, now time.Time) RateLimitResult {
+	sw.advance(p.Window, now)
+	allowed := sw.count(now)+1 <= float64(p.Requests)
+	if allowed {
+		sw.curr++
+	}
+	return sw.result(p, allowed, now)
+}
+
+// slidingWindow.result describes the counts after a request was admitted or
+// rejected
+func (sw *slidingWindow) result(p *RateLimitPolicy, allowed bool, now time.Time) RateLimitResult {
+	limit := float64(p.Requests)
+	result := RateLimitResult{
+		Allowed:   allowed,
+		Limit:     p.Requests,
+		Remaining: max(0, int(limit-math.Ceil(sw.count(now)))),
+	}
+	if !allowed {
+		result.RetryAfter = sw.retryAfter(limit, now)
+	}
+
+	elapsed := now.Sub(sw.start)
+	switch {
+	case sw.curr > 0:
+		result.Reset = 2*sw.window - elapsed
+	case sw.prev > 0:
+		result.Reset = sw.window - elapsed
+	}
+	return result
+}
+
+func (sw *slidingWindow) Idle(now time.Time) bool {
+	return (sw.prev == 0 && sw.curr == 0) || now.Sub(sw.start) >= 2*sw.window
+}
+
+// slidingWindow.advance moves the current window forward to cover now,
+// starting over if the policy's window changed
+func (sw *slidingWindow) advance(window time.Duration, now time.Time) {
+	if sw.window != window {
+		*sw = slidingWindow{start: now, window: window}
+		return
+	}
+	switch n := now.Sub(sw.start) / window; {
+	case n == 1:
+		sw.prev, sw.curr = sw.curr, 0
+		sw.start = sw.start.Add(window)
+	case n > 1:
+		sw.prev, sw.curr = 0, 0
+		sw.start = sw.start.Add(n * window)
+	}
+}
+
+// slidingWindow.count estimates the requests in the sliding window ending
+// at now
+func (sw *slidingWindow) count(now time.Time) float64 {
+	overlap := 1 - float64(now.Sub(sw.start))/float64(sw.window)
+	return float64(sw.prev)*overlap + float64(sw.curr)
+}
+
+// slidingWindow.retryAfter returns how long until count leaves room for one
+// more request
+func (sw *slidingWindow) retryAfter(limit float64, now time.Time) time.Duration {
+	elapsed := float64(now.Sub(sw.start))
+	window := float64(sw.window)
+	if room := limit - 1 - float64(sw.curr); room >= 0 {
+		// The previous window's share has to shrink to room
+		return time.Duration(window - elapsed - room*window/float64(sw.prev))
+	}
+	// The current window has to become the previous one and shrink
+	return time.Duration(2*window - elapsed - (limit-1)*window/float64(sw.curr))
+}
+
+// slidingLog records the time of each admitted request and allows one more
+// while fewer than the policy's requests fall within the last window. It is
+// exact but keeps up to that many timestamps per client.
+type slidingLog struct {
+	times  []time.Time // oldest first
+	window time.Duration
+}
+
+func (sl *slidingLog) Take(p *RateLimitPolicy, now time.Time) RateLimitResult {
+	sl.window = p.Window
+	sl.expire(now)
+	allowed := len(sl.times) < p.Requests
+	if allowed {
+		sl.times = append(sl.times, now)
+	}
+
+	var oldest, newest time.Time
+	if n := len(sl.times); n > 0 {
+		oldest, newest = sl.times[max(0, n-p.Requests)], sl.times[n-1]
+	}
+	return logResult(p, allowed, len(sl.times), oldest, newest, now)
+}
+
+// logResult describes a sliding log of n requests after one was admitted or
+// rejected. oldest is the request that has to leave the window before
+// another is allowed, and newest the last one admitted.
+func logResult(p *RateLimitPolicy, allowed bool, n int, oldest, newest time.Time, now time.Time) RateLimitResult {
+	result := RateLimitResult{
+		Allowed:   allowed,
+		Limit:     p.Requests,
+		Remaining: max(0, p.Requests-n),
+	}
+	if !allowed {
+		result.RetryAfter = oldest.Add(p.Window).Sub(now)
+	}
+	if n > 0 {
+		result.Reset = newest.Add(p.Window).Sub(now)
+	}
+	return result
+}
+
+func (sl *slidingLog) Idle(now time.Time) bool {
+	n := len(sl.times)
+	return n == 0 || !sl.times[n-1].Add(sl.window).After(now)
+}
+
+// slidingLog.expire drops the requests that have left the window
+func (sl *slidingLog) expire(now time.Time) {
+	cutoff := now.Add(-sl.window)
+	i := 0
+	for i < len(sl.times) && !sl.times[i].After(cutoff) {
+		i++
+	}
+	if i > 0 {
+		n := copy(sl.times, sl.times[i:])
+		sl.times = sl.times[:n]
+	}
+}
+
+// gcra is the generic cell rate algorithm. It tracks the theoretical arrival
+// time (TAT) of the next request at the sustained rate and admits a request
+// unless that lies more than a burst's worth of intervals in the future.
+// It behaves like a token bucket in a single timestamp, and with burst 1 it
+// spaces requests evenly.
+type gcra struct {
+	tat time.Time
+}
+
+func (g *gcra) Take(p *RateLimitPolicy, now time.Time) RateLimitResult {
+	interval, tolerance := gcraParams(p)
+	tat := g.tat
+	if tat.Before(now) {
+		tat = now
+	}
+	next := tat.Add(interval)
+	allowed := !next.Add(-tolerance).After(now)
+	if allowed {
+		g.tat = next
+	}
+	return g.result(p, allowed, now)
+}
+
+// gcraParams returns the emission interval between requests at the
+// sustained rate and how far ahead of now the TAT may run
+func gcraParams(p *RateLimitPolicy) (interval, tolerance time.Duration) {
+	interval = time.Duration(float64(p.Window) / float64(p.Requests))
+	return interval, time.Duration(p.Burst) * interval
+}
+
+// gcra.result describes the TAT after a request was admitted or rejected
+func (g *gcra) result(p *RateLimitPolicy, allowed bool, now time.Time) RateLimitResult {
+	interval, tolerance := gcraParams(p)
+	ahead := max(0, g.tat.Sub(now))
+	result := RateLimitResult{
+		Allowed:   allowed,
+		Limit:     p.Burst,
+		Remaining: max(0, int((tolerance-ahead)/interval)),
+		Reset:     ahead,
+	}
+	if !allowed {
+		result.RetryAfter = ahead + interval - tolerance
+	}
+	return result
+}
+
+func (g *gcra) Idle(now time.Time) bool {
+	return !g.tat.After(now)
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// algorithms lists every rate limiting algorithm the limiter tests cover
+var algorithms = []string{
+	algorithmTokenBucket,
+	algorithmGCRA,
+	algorithmSlidingWindow,
+	algorithmSlidingLog,
+}
+
+// testPolicy returns a policy of 10 requests per 10s under algorithm, with
+// the default burst of 10
+func testPolicy(algorithm string) *RateLimitPolicy {
+	return newRateLimitPolicy("test", "test", RateLimitPolicyConfig{
+		Requests:  10,
+		Window:    10 * time.Second,
+		Algorithm: algorithm,
+	})
+}
+
+// epoch is the synthetic clock's starting time
+var epoch = time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// TestLimiterBurst spends a new client's quota at a single instant and checks
+// what each algorithm reports along the way and once it rejects
+func TestLimiterBurst(t *testing.T) {
+	tests := []struct {
+		algorithm string
+		// Reset after the k-th admitted request, for k from 1
+		reset func(k int) time.Duration
+		// Reset and RetryAfter of the first rejected request
+		rejectReset time.Duration
+		retryAfter  time.Duration
+	}{
+		{
+			algorithm:   algorithmTokenBucket,
+			reset:       func(k int) time.Duration { return time.Duration(k) * time.Second },
+			rejectReset: 10 * time.Second,
+			retryAfter:  time.Second,
+		},
+		{
+			algorithm:   algorithmGCRA,
+			reset:       func(k int) time.Duration { return time.Duration(k) * time.Second },
+			rejectReset: 10 * time.Second,
+			retryAfter:  time.Second,
+		},
+		{
+			// Counts leave the sliding window once the next fixed window ends
+			algorithm:   algorithmSlidingWindow,
+			reset:       func(int) time.Duration { return 20 * time.Second },
+			rejectReset: 20 * time.Second,
+			retryAfter:  11 * time.Second,
+		},
+		{
+			algorithm:   algorithmSlidingLog,
+			reset:       func(int) time.Duration { return 10 * time.Second },
+			rejectReset: 10 * time.Second,
+			retryAfter:  10 * time.Second,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.algorithm, func(t *testing.T) {
+			p := testPolicy(tt.algorithm)
+			l := newLimiter(p, epoch)
+
+			for k := 1; k <= 10; k++ {
+				res := l.Take(p, epoch)
+				if !res.Allowed {
+					t.Fatalf("request %d rejected", k)
+				}
+				if res.Limit != 10 {
+					t.Errorf("request %d: Limit = %d, want 10", k, res.Limit)
+				}
+				if res.Remaining != 10-k {
+					t.Errorf("request %d: Remaining = %d, want %d", k, res.Remaining, 10-k)
+				}
+				if want := tt.reset(k); res.Reset != want {
+					t.Errorf("request %d: Reset = %v, want %v", k, res.Reset, want)
+				}
+				if res.RetryAfter != 0 {
+					t.Errorf("request %d: RetryAfter = %v, want 0", k, res.RetryAfter)
+				}
+			}
+
+			res := l.Take(p, epoch)
+			if res.Allowed {
+				t.Fatal("request 11 allowed")
+			}
+			if res.Remaining != 0 {
+				t.Errorf("rejected: Remaining = %d, want 0", res.Remaining)
+			}
+			if res.Reset != tt.rejectReset {
+				t.Errorf("rejected: Reset = %v, want %v", res.Reset, tt.rejectReset)
+			}
+			if res.RetryAfter != tt.retryAfter {
+				t.Errorf("rejected: RetryAfter = %v, want %v", res.RetryAfter, tt.retryAfter)
+			}
+		})
+	}
+}
+
+// TestLimiterRetryAfter checks that a rejected client is admitted once
+// RetryAfter has passed and not a millisecond sooner
+func TestLimiterRetryAfter(t *testing.T) {
+	for _, algorithm := range algorithms {
+		t.Run(algorithm, func(t *testing.T) {
+			p := testPolicy(algorithm)
+			l := newLimiter(p, epoch)
+
+			now := epoch
+			for i := 0; i < 5; i++ {
+				var res RateLimitResult
+				for res = l.Take(p, now); res.Allowed; res = l.Take(p, now) {
+				}
+				if res.RetryAfter <= 0 {
+					t.Fatalf("round %d: RetryAfter = %v, want positive", i, res.RetryAfter)
+				}
+
+				if res := l.Take(p, now.Add(res.RetryAfter-time.Millisecond)); res.Allowed {
+					t.Fatalf("round %d: allowed before RetryAfter", i)
+				}
+				now = now.Add(res.RetryAfter)
+				if res := l.Take(p, now); !res.Allowed {
+					t.Fatalf("round %d: rejected after RetryAfter (retry after %v more)", i, res.RetryAfter)
+				}
+			}
+		})
+	}
+}
+
+// TestLimiterReset checks that a client is back to a new client's state
+// once Reset has passed
+func TestLimiterReset(t *testing.T) {
+	for _, algorithm := range algorithms {
+		t.Run(algorithm, func(t *testing.T) {
+			p := testPolicy(algorithm)
+			l := newLimiter(p, epoch)
+			if !l.Idle(epoch) {
+				t.Fatal("new client not idle")
+			}
+
+			var res RateLimitResult
+			for i := 0; i < 3; i++ {
+				res = l.Take(p, epoch.Add(time.Duration(i)*time.Second))
+			}
+			now := epoch.Add(2 * time.Second)
+			if l.Idle(now) {
+				t.Fatal("idle right after requests")
+			}
+			if l.Idle(now.Add(res.Reset - time.Millisecond)) {
+				t.Errorf("idle before Reset %v passed", res.Reset)
+			}
+			if !l.Idle(now.Add(res.Reset)) {
+				t.Errorf("not idle once Reset %v passed", res.Reset)
+			}
+		})
+	}
+}
+
+// TestLimiterSustainedRate offers a request every 250ms for a minute and
+// checks how many each algorithm admits overall and within any window
+func TestLimiterSustainedRate(t *testing.T) {
+	tests := []struct {
+		algorithm string
+		admitted  int
+		// Most requests admitted within any 10s window
+		perWindow int
+	}{
+		// The burst, then one per second
+		{algorithmTokenBucket, 70, 19},
+		{algorithmGCRA, 70, 19},
+		// Never more than the policy's requests in any window; the counter's
+		// estimate errs on the side of admitting fewer than the exact log
+		{algorithmSlidingWindow, 56, 10},
+		{algorithmSlidingLog, 61, 10},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.algorithm, func(t *testing.T) {
+			p := testPolicy(tt.algorithm)
+			l := newLimiter(p, epoch)
+
+			var admitted []time.Time
+			for now := epoch; !now.After(epoch.Add(time.Minute)); now = now.Add(250 * time.Millisecond) {
+				if l.Take(p, now).Allowed {
+					admitted = append(admitted, now)
+				}
+			}
+			if len(admitted) != tt.admitted {
+				t.Errorf("admitted %d requests, want %d", len(admitted), tt.admitted)
+			}
+
+			most := 0
+			for i, at := range admitted {
+				n := 0
+				for _, other := range admitted[:i+1] {
+					if other.After(at.Add(-p.Window)) {
+						n++
+					}
+				}
+				most = max(most, n)
+			}
+			if most != tt.perWindow {
+				t.Errorf("admitted up to %d requests within %v, want %d", most, p.Window, tt.perWindow)
+			}
+		})
+	}
+}
+
+// TestGCRASpacing checks that GCRA with a burst of 1 spaces requests evenly
+func TestGCRASpacing(t *testing.T) {
+	p := newRateLimitPolicy("test", "test", RateLimitPolicyConfig{
+		Requests:  5,
+		Window:    time.Second,
+		Burst:     1,
+		Algorithm: algorithmGCRA,
+	})
+	l := newLimiter(p, epoch)
+
+	if !l.Take(p, epoch).Allowed {
+		t.Fatal("first request rejected")
+	}
+	res := l.Take(p, epoch.Add(150*time.Millisecond))
+	if res.Allowed {
+		t.Fatal("request 150ms later allowed")
+	}
+	if res.RetryAfter != 50*time.Millisecond {
+		t.Errorf("RetryAfter = %v, want 50ms", res.RetryAfter)
+	}
+	if !l.Take(p, epoch.Add(200*time.Millisecond)).Allowed {
+		t.Error("request 200ms later rejected")
+	}
+}
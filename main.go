@@ -1,57 +1,97 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
 	"os"
+	"os/signal"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
 // Config holds gateway configuration
 type Config struct {
-	Port                int
-	Backends            []string
-	RateLimitPerIP      int
-	RateLimitPerKey     int
-	HealthCheckInterval time.Duration
-	APIKeys             map[string]bool
+	ListenAddr              string
+	LogFile                 string
+	Backends                []BackendConfig
+	RateLimitPerIP          int
+	RateLimitPerKey         int
+	RateLimitMaxClients     int
+	RateLimitAlgorithm      string
+	RateLimitRedis          *RedisConfig
+	KeyRateLimits           map[string][]*RateLimitPolicy
+	HealthCheckInterval     time.Duration
+	DrainDelay              time.Duration
+	DrainTimeout            time.Duration
+	RetryBudgetRatio        float64
+	RetryBudgetMinPerSecond int
+	Timeouts                TimeoutConfig
+	APIKeys                 map[string]Tier
+	LoadShedding            *LoadSheddingConfig
+	Pools                   map[string]PoolConfig
+	Routes                  []RouteConfig
+	NotFoundBody            []byte
 }
 
-// LoadBalancer implements round-robin load balancing
+// LoadBalancer picks healthy backends using a pluggable Strategy
 type LoadBalancer struct {
 	backends []*Backend
-	current  int
+	strategy Strategy
+	breaker  *CircuitBreaker // nil when the pool has no circuit breaker
 	mu       sync.Mutex
 }
 
 // Backend represents an upstream server
 type Backend struct {
-	URL   *url.URL
-	Proxy *httputil.ReverseProxy
-	Alive bool
-	mu    sync.Mutex
-}
-
-// RateLimiter implements per-IP and per-key rate limiting
-type RateLimiter struct {
-	ipLimits  map[string]*TokenBucket
-	keyLimits map[string]*TokenBucket
-	mu        sync.RWMutex
-}
-
-// TokenBucket for rate limiting
-type TokenBucket struct {
-	tokens     float64
-	capacity   float64
-	refillRate float64
-	lastRefill time.Time
+	URL    *url.URL
+	Proxy  *httputil.ReverseProxy
+	Alive  bool
+	Weight int
+	mu     sync.Mutex
+
+	// id identifies the backend in affinity cookies without exposing its URL
+	id string
+
+	// currentWeight is the smooth weighted round-robin state, guarded by the
+	// LoadBalancer's mutex
+	currentWeight int
+
+	// inFlight counts requests being proxied; ewma is the peak-EWMA latency
+	// in nanoseconds, guarded by mu
+	inFlight    atomic.Int64
+	ewma        float64
+	ewmaUpdated time.Time
+
+	// Active health check state, guarded by mu
+	nextCheck time.Time
+	checking  bool
+	successes int
+	failures  int
+
+	// Outlier detection state, guarded by mu
+	consecutive5xx  int
+	gatewayFailures int
+	ejections       int
+	ejectedUntil    time.Time
+
+	// Circuit breaker state, guarded by mu
+	breaker breakerState
+
+	// queue and adaptive enforce the pool's static and adaptive per-backend
+	// concurrency limits
+	queue    Bulkhead
+	adaptive AdaptiveLimiter
 }
 
 // RequestLogger logs all requests and responses
@@ -65,46 +105,54 @@ type LogEntry struct {
 	Timestamp    string `json:"timestamp"`
 	Method       string `json:"method"`
 	Path         string `json:"path"`
+	UpstreamPath string `json:"upstream_path,omitempty"`
 	ClientIP     string `json:"client_ip"`
 	APIKey       string `json:"api_key,omitempty"`
+	Tier         string `json:"tier,omitempty"`
 	StatusCode   int    `json:"status_code"`
 	ResponseTime string `json:"response_time_ms"`
+	Pool         string `json:"pool,omitempty"`
 	Backend      string `json:"backend"`
+	Breaker      string `json:"breaker,omitempty"`
+	Attempts     int    `json:"attempts,omitempty"`
+	QueueDepth   int    `json:"queue_depth,omitempty"`
+	QueueWait    string `json:"queue_wait_ms,omitempty"`
+	HedgeWinner  int    `json:"hedge_winner,omitempty"`
 	Error        string `json:"error,omitempty"`
 }
 
 // Gateway is the main API gateway
 type Gateway struct {
 	config      *Config
-	lb          *LoadBalancer
+	router      *Router
 	rateLimiter *RateLimiter
+	retryBudget *RetryBudget
+	shedder     *LoadShedder
 	logger      *RequestLogger
 	mux         *http.ServeMux
+	server      *http.Server
+	listener    net.Listener
+	mu          sync.RWMutex
+
+	// draining fails /health during shutdown; stop ends the background loops
+	draining atomic.Bool
+	stop     chan struct{}
+
+	// newConns holds accepted connections that have not sent a request yet
+	newConns   map[net.Conn]bool
+	newConnsMu sync.Mutex
 }
 
 // NewGateway creates a new gateway instance
 func NewGateway(config *Config) (*Gateway, error) {
-	lb := &LoadBalancer{
-		backends: make([]*Backend, 0),
-	}
-
-	// Initialize backends
-	for _, backendURL := range config.Backends {
-		parsedURL, err := url.Parse(backendURL)
-		if err != nil {
-			return nil, fmt.Errorf("invalid backend URL: %s", backendURL)
-		}
-
-		backend := &Backend{
-			URL:   parsedURL,
-			Proxy: httputil.NewSingleHostReverseProxy(parsedURL),
-			Alive: true,
-		}
-		lb.backends = append(lb.backends, backend)
+	// Initialize pools and routes
+	router, err := NewRouter(config, nil)
+	if err != nil {
+		return nil, err
 	}
 
 	// Create logger
-	logFile, err := os.OpenFile("gateway.log", os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	logFile, err := os.OpenFile(config.LogFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
 	if err != nil {
 		return nil, err
 	}
@@ -112,15 +160,29 @@ func NewGateway(config *Config) (*Gateway, error) {
 	logger := &RequestLogger{file: logFile}
 
 	g := &Gateway{
-		config: config,
-		lb:     lb,
-		rateLimiter: &RateLimiter{
-			ipLimits:  make(map[string]*TokenBucket),
-			keyLimits: make(map[string]*TokenBucket),
+		config:      config,
+		router:      router,
+		rateLimiter: &RateLimiter{},
+		retryBudget: &RetryBudget{
+			Ratio:        config.RetryBudgetRatio,
+			MinPerSecond: config.RetryBudgetMinPerSecond,
 		},
-		logger: logger,
-		mux:    http.NewServeMux(),
+		shedder: &LoadShedder{},
+		logger:  logger,
+		mux:     http.NewServeMux(),
+		stop:    make(chan struct{}),
+
+		newConns: make(map[net.Conn]bool),
 	}
+	g.server = &http.Server{
+		Addr:        config.ListenAddr,
+		Handler:     g.mux,
+		ReadTimeout: 15 * time.Second,
+		ConnState:   g.trackConn,
+	}
+	g.rateLimiter.Configure(config)
+	g.shedder.sample = g.load
+	g.shedder.Configure(config.LoadShedding)
 
 	// Setup routes
 	g.mux.HandleFunc("/health", g.handleHealth)
@@ -129,22 +191,67 @@ func NewGateway(config *Config) (*Gateway, error) {
 	return g, nil
 }
 
-// Start starts the gateway server
+// newBackend creates a backend proxying to rawURL
+func newBackend(rawURL string, weight int) (*Backend, error) {
+	parsedURL, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid backend URL: %s", rawURL)
+	}
+
+	proxy := httputil.NewSingleHostReverseProxy(parsedURL)
+	proxy.Transport = upstreamTransport
+	proxy.ErrorHandler = proxyErrorHandler
+
+	return &Backend{
+		URL:    parsedURL,
+		Proxy:  proxy,
+		Alive:  true,
+		Weight: weight,
+		id:     fmt.Sprintf("%016x", hash64(parsedURL.String())),
+	}, nil
+}
+
+// currentConfig returns the active configuration
+func (g *Gateway) currentConfig() *Config {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	return g.config
+}
+
+// currentRouter returns the active router
+func (g *Gateway) currentRouter() *Router {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	return g.router
+}
+
+// Start starts the gateway server, on the listener inherited from the
+// previous process after an upgrade. It returns nil once Shutdown has closed
+// the listener.
 func (g *Gateway) Start() error {
 	// Start health checks
 	go g.healthCheckLoop()
 
-	log.Printf("Gateway starting on :%d", g.config.Port)
-	log.Printf("Routing to backends: %v", g.config.Backends)
+	config := g.currentConfig()
+	log.Printf("Gateway starting on %s", config.ListenAddr)
+	for _, pool := range g.currentRouter().Pools() {
+		log.Printf("Pool %s routing to backends: %v", pool.Name, pool.LB.URLs())
+	}
 
-	server := &http.Server{
-		Addr:         fmt.Sprintf(":%d", g.config.Port),
-		Handler:      g.mux,
-		ReadTimeout:  15 * time.Second,
-		WriteTimeout: 15 * time.Second,
+	ln, err := listen(config.ListenAddr)
+	if err != nil {
+		return err
 	}
+	g.mu.Lock()
+	g.listener = ln
+	g.mu.Unlock()
+	notifyReady()
 
-	return server.ListenAndServe()
+	err = g.server.Serve(ln)
+	if err != http.ErrServerClosed && !errors.Is(err, net.ErrClosed) {
+		return err
+	}
+	return nil
 }
 
 // handleHealth returns gateway health status
@@ -154,23 +261,84 @@ func (g *Gateway) handleHealth(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	g.lb.mu.Lock()
-	healthy := 0
-	for _, b := range g.lb.backends {
-		if b.Alive {
-			healthy++
+	healthy, total := 0, 0
+	pools := make(map[string]interface{})
+	for _, pool := range g.currentRouter().Pools() {
+		pool.LB.mu.Lock()
+		poolHealthy := 0
+		backends := make([]map[string]interface{}, 0, len(pool.LB.backends))
+		for _, b := range pool.LB.backends {
+			alive := b.IsAlive()
+			if alive {
+				poolHealthy++
+			}
+			_, queued := b.queue.Stats()
+			backends = append(backends, map[string]interface{}{
+				"url":               b.URL.String(),
+				"alive":             alive,
+				"ejected":           b.Ejected(time.Now()),
+				"breaker":           b.BreakerState(),
+				"weight":            b.Weight,
+				"in_flight":         b.InFlight(),
+				"queued":            queued,
+				"queue_wait":        b.queue.waitStatus(),
+				"concurrency_limit": b.adaptive.Limit(),
+				"latency_ms":        float64(b.Latency().Microseconds()) / 1000,
+			})
 		}
+		poolTotal := len(pool.LB.backends)
+		strategy := pool.LB.strategy.Name()
+		pool.LB.mu.Unlock()
+
+		pools[pool.Name] = map[string]interface{}{
+			"strategy":         strategy,
+			"healthy_backends": poolHealthy,
+			"total_backends":   poolTotal,
+			"backends":         backends,
+		}
+		healthy += poolHealthy
+		total += poolTotal
+	}
+
+	routes := make([]map[string]interface{}, 0)
+	for _, route := range g.currentRouter().routes {
+		if route.Queue == nil {
+			continue
+		}
+		inFlight, queued := route.Queue.Stats()
+		routes = append(routes, map[string]interface{}{
+			"route":      route.String(),
+			"limit":      route.Queue.Limit,
+			"in_flight":  inFlight,
+			"queued":     queued,
+			"queue_wait": route.Queue.waitStatus(),
+		})
 	}
-	g.lb.mu.Unlock()
 
 	status := map[string]interface{}{
 		"status":           "ok",
+		"routes":           routes,
 		"healthy_backends": healthy,
-		"total_backends":   len(g.lb.backends),
+		"total_backends":   total,
+		"pools":            pools,
 		"timestamp":        time.Now().UTC().Format(time.RFC3339),
+		"rate_limit_clients": map[string]int{
+			"ip":  g.rateLimiter.ips.Len(),
+			"key": g.rateLimiter.keys.Len(),
+		},
+	}
+	if shedding := g.shedder.Status(); shedding != nil {
+		status["load_shedding"] = shedding
+	}
+	if redis := g.rateLimiter.Status(); redis != nil {
+		status["rate_limit_redis"] = redis
 	}
 
 	w.Header().Set("Content-Type", "application/json")
+	if g.draining.Load() {
+		status["status"] = "draining"
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
 	json.NewEncoder(w).Encode(status)
 }
 
@@ -182,7 +350,8 @@ func (g *Gateway) handleRequest(w http.ResponseWriter, r *http.Request) {
 	}
 
 	startTime := time.Now()
-	clientIP := strings.Split(r.RemoteAddr, ":")[0]
+	clientIP := remoteIP(r)
+	config := g.currentConfig()
 
 	// Log entry
 	logEntry := LogEntry{
@@ -194,49 +363,229 @@ func (g *Gateway) handleRequest(w http.ResponseWriter, r *http.Request) {
 
 	// Auth middleware: check API key if required
 	apiKey := r.Header.Get("X-API-Key")
+	tier := TierAnonymous
 	if apiKey != "" {
 		logEntry.APIKey = apiKey
-		if !g.config.APIKeys[apiKey] {
+		var ok bool
+		if tier, ok = config.APIKeys[apiKey]; !ok {
 			logEntry.StatusCode = http.StatusUnauthorized
 			logEntry.Error = "invalid API key"
 			g.logger.Log(logEntry)
 			http.Error(w, "Unauthorized: invalid API key", http.StatusUnauthorized)
 			return
 		}
+		logEntry.Tier = tier.String()
 	}
 
-	// Rate limiting
-	if !g.rateLimiter.Allow(clientIP, apiKey, g.config) {
+	// Load shedding: drop lower tiers first while overloaded
+	if g.shedder.Shed(tier) {
+		logEntry.StatusCode = http.StatusServiceUnavailable
+		logEntry.Error = "shed under overload"
+		g.logger.Log(logEntry)
+		writeOverloaded(w, time.Second, errOverloaded)
+		return
+	}
+
+	// Rate limiting, including the matched route's policies
+	router := g.currentRouter()
+	route := router.Match(r)
+	limit := g.rateLimiter.Allow(r, clientIP, apiKey, route, config)
+	setRateLimitHeaders(w, limit)
+	if !limit.Allowed {
 		logEntry.StatusCode = http.StatusTooManyRequests
-		logEntry.Error = "rate limit exceeded"
+		logEntry.Error = limit.Scope + " rate limit exceeded"
 		g.logger.Log(logEntry)
-		http.Error(w, "Rate limit exceeded", http.StatusTooManyRequests)
+		writeRateLimited(w, limit)
 		return
 	}
 
+	// Find the route's pool
+	if route == nil {
+		logEntry.StatusCode = http.StatusNotFound
+		logEntry.Error = "no matching route"
+		g.logger.Log(logEntry)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		w.Write(router.notFound)
+		return
+	}
+	logEntry.Pool = route.Pool.Name
+
+	// Bound the request by the route's timeouts
+	route.Timeouts.SetWriteDeadline(w, r)
+	ctx, cancel := route.Timeouts.Context(r)
+	defer cancel()
+	priority := route.Priority + int(tier)
+	ctx = withPriority(ctx, priority)
+	r = r.WithContext(ctx)
+
+	// Wait for a slot under the route's concurrency limit
+	var queueWait time.Duration
+	if route.Queue != nil {
+		wait, depth, err := route.Queue.Acquire(ctx, priority)
+		queueWait = wait
+		logEntry.QueueDepth = depth
+		if err != nil {
+			if wait > 0 {
+				logEntry.QueueWait = formatMillis(wait)
+			}
+			logEntry.Error = err.Error()
+			if errors.Is(err, context.Canceled) {
+				// The client went away while queued, with no one left to
+				// reply to
+				logEntry.StatusCode = statusClientClosedRequest
+				logEntry.Error = "client went away while queued"
+				g.logger.Log(logEntry)
+				return
+			}
+			if isTimeout(err) {
+				// The route's deadline ran out while queued
+				logEntry.StatusCode = http.StatusGatewayTimeout
+				g.logger.Log(logEntry)
+				writeTimeout(w)
+				return
+			}
+			logEntry.StatusCode = http.StatusServiceUnavailable
+			g.logger.Log(logEntry)
+			writeOverloaded(w, route.Queue.RetryAfter(), err)
+			return
+		}
+		defer route.Queue.Release()
+	}
+
 	// Get healthy backend
-	backend := g.lb.Next()
+	backend, affinity := route.Pool.Next(r)
 	if backend == nil {
 		logEntry.StatusCode = http.StatusServiceUnavailable
 		logEntry.Error = "no healthy backends available"
+		if route.Pool.LB.BreakersOpen() {
+			logEntry.Breaker = breakerOpen
+			logEntry.Error = "circuit breakers open"
+		}
 		g.logger.Log(logEntry)
 		http.Error(w, "Service unavailable", http.StatusServiceUnavailable)
 		return
 	}
 
 	logEntry.Backend = backend.URL.String()
+	if state := backend.BreakerState(); state != breakerClosed {
+		logEntry.Breaker = state
+	}
+	if affinity != nil {
+		http.SetCookie(w, affinity)
+	}
 
 	// Wrap response writer to capture status code
 	wrapped := &responseWriter{ResponseWriter: w, statusCode: http.StatusOK}
 
-	// Forward request
-	backend.Proxy.ServeHTTP(wrapped, r)
+	// Apply the route's path rewrite
+	outReq := r
+	if route.Rewrite != nil {
+		outReq = route.Rewrite.Apply(r)
+		logEntry.UpstreamPath = outReq.URL.Path
+	}
+
+	// Buffer the body so a failed attempt can be replayed
+	retry := route.Retry
+	var body []byte
+	if retry != nil {
+		var ok bool
+		if body, ok = retry.bufferBody(outReq); !ok {
+			retry = nil
+		}
+	}
+	g.retryBudget.Request()
+
+	// Forward request, hedging slow reads or retrying failed attempts on
+	// another backend as the route allows
+	var result ProxyResult
+	if route.Hedge != nil && route.Hedge.eligible(outReq) {
+		won, attempts := route.Hedge.Forward(route.Pool, backend, wrapped, outReq)
+		result = won.result
+		logEntry.Attempts = attempts
+		logEntry.Backend = won.backend.URL.String()
+		if attempts > 1 {
+			logEntry.HedgeWinner = won.attempt
+		}
+	} else {
+		tried := make(map[*Backend]bool)
+		for attempt := 1; ; attempt++ {
+			tried[backend] = true
+			logEntry.Attempts = attempt
+
+			var hold func(status int, err error) bool
+			if retry != nil && attempt < retry.Attempts {
+				hold = func(status int, err error) bool {
+					return retry.retryable(status, err) && g.retryBudget.Withdraw()
+				}
+			}
+			result = backend.Forward(wrapped, withBody(outReq, body), hold)
+			route.Pool.Observe(backend, result)
+			if !result.Held {
+				break
+			}
+
+			select {
+			case <-time.After(retry.backoff(attempt)):
+			case <-ctx.Done():
+				if ctx.Err() == context.DeadlineExceeded {
+					logEntry.StatusCode = http.StatusGatewayTimeout
+					logEntry.Error = "request timed out before retry"
+					g.logger.Log(logEntry)
+					writeTimeout(w)
+					return
+				}
+				logEntry.StatusCode = http.StatusBadGateway
+				logEntry.Error = "client went away before retry"
+				g.logger.Log(logEntry)
+				return
+			}
+
+			backend, affinity = route.Pool.NextRetry(r, tried)
+			if backend == nil {
+				logEntry.StatusCode = http.StatusServiceUnavailable
+				logEntry.Error = "no healthy backends available for retry"
+				g.logger.Log(logEntry)
+				http.Error(w, "Service unavailable", http.StatusServiceUnavailable)
+				return
+			}
+			logEntry.Backend = backend.URL.String()
+			if affinity != nil {
+				w.Header().Del("Set-Cookie")
+				http.SetCookie(w, affinity)
+			}
+		}
+	}
 
 	// Log response
 	logEntry.StatusCode = wrapped.statusCode
-	logEntry.ResponseTime = fmt.Sprintf("%.2f", time.Since(startTime).Milliseconds())
+	if queueWait += result.QueueWait; queueWait > 0 {
+		logEntry.QueueWait = formatMillis(queueWait)
+	}
+	if result.QueueDepth > logEntry.QueueDepth {
+		logEntry.QueueDepth = result.QueueDepth
+	}
+	if result.Err != nil {
+		logEntry.Error = result.Err.Error()
+	}
+	logEntry.ResponseTime = fmt.Sprintf("%.2f", float64(time.Since(startTime).Microseconds())/1000)
 
 	g.logger.Log(logEntry)
+
+	// Cut off the client as the proxy would have, so a truncated body
+	// isn't mistaken for a complete one
+	if result.Aborted {
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// remoteIP returns the IP address of the connecting client
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
 }
 
 // responseWriter wraps http.ResponseWriter to capture status code
@@ -254,6 +603,11 @@ func (w *responseWriter) WriteHeader(statusCode int) {
 	}
 }
 
+// Unwrap lets http.ResponseController reach the underlying writer
+func (w *responseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
 func (w *responseWriter) Write(b []byte) (int, error) {
 	if !w.written {
 		w.written = true
@@ -261,147 +615,236 @@ func (w *responseWriter) Write(b []byte) (int, error) {
 	return w.ResponseWriter.Write(b)
 }
 
-// LoadBalancer.Next returns next healthy backend
-func (lb *LoadBalancer) Next() *Backend {
+// LoadBalancer.Next returns a healthy backend for r chosen by the pool's
+// strategy. Backends with weight 0, ejected as outliers or behind an open
+// circuit breaker get no traffic.
+func (lb *LoadBalancer) Next(r *http.Request) *Backend {
+	return lb.NextExcept(r, nil)
+}
+
+// LoadBalancer.NextExcept is Next skipping the backends in exclude
+func (lb *LoadBalancer) NextExcept(r *http.Request, exclude map[*Backend]bool) *Backend {
 	lb.mu.Lock()
 	defer lb.mu.Unlock()
 
-	if len(lb.backends) == 0 {
-		return nil
-	}
-
-	// Find next alive backend
-	start := lb.current
-	for i := 0; i < len(lb.backends); i++ {
-		idx := (start + i) % len(lb.backends)
-		if lb.backends[idx].Alive {
-			lb.current = (idx + 1) % len(lb.backends)
-			return lb.backends[idx]
+	now := time.Now()
+	candidates := make([]*Backend, 0, len(lb.backends))
+	for _, b := range lb.backends {
+		if !exclude[b] && lb.available(b, now) {
+			candidates = append(candidates, b)
 		}
 	}
 
-	return nil
+	backend := lb.strategy.Pick(candidates, r)
+	if backend != nil && lb.breaker != nil {
+		lb.breaker.acquire(backend, now)
+	}
+	return backend
 }
 
-// RateLimiter.Allow checks if request is allowed
-func (rl *RateLimiter) Allow(ip, key string, config *Config) bool {
-	rl.mu.Lock()
-	defer rl.mu.Unlock()
+// LoadBalancer.Lookup returns the backend with the given id if it can take
+// a request, or nil
+func (lb *LoadBalancer) Lookup(id string) *Backend {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
 
-	// Check IP limit
-	if !rl.allowIP(ip, config.RateLimitPerIP) {
-		return false
+	now := time.Now()
+	for _, b := range lb.backends {
+		if b.id == id && lb.available(b, now) {
+			if lb.breaker != nil {
+				lb.breaker.acquire(b, now)
+			}
+			return b
+		}
 	}
+	return nil
+}
 
-	// Check key limit
-	if key != "" && !rl.allowKey(key, config.RateLimitPerKey) {
+// available reports whether b can take a request. The caller holds lb.mu.
+func (lb *LoadBalancer) available(b *Backend, now time.Time) bool {
+	if !b.IsAlive() || b.Weight <= 0 || b.Ejected(now) {
 		return false
 	}
+	return lb.breaker == nil || lb.breaker.allows(b, now)
+}
 
-	return true
+// LoadBalancer.Breaker returns the pool's circuit breaker, or nil
+func (lb *LoadBalancer) Breaker() *CircuitBreaker {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	return lb.breaker
 }
 
-func (rl *RateLimiter) allowIP(ip string, limit int) bool {
-	bucket, exists := rl.ipLimits[ip]
-	if !exists {
-		bucket = &TokenBucket{
-			tokens:     float64(limit),
-			capacity:   float64(limit),
-			refillRate: float64(limit) / 60.0, // per second
-			lastRefill: time.Now(),
+// LoadBalancer.SetBreaker switches the circuit breaker settings. Backends
+// keep their breaker state, unless the breaker is removed, which leaves them
+// all closed.
+func (lb *LoadBalancer) SetBreaker(breaker *CircuitBreaker) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	lb.breaker = breaker
+	if breaker == nil {
+		for _, b := range lb.backends {
+			b.mu.Lock()
+			b.breaker = breakerState{}
+			b.mu.Unlock()
 		}
-		rl.ipLimits[ip] = bucket
 	}
+}
 
-	bucket.refill()
-	if bucket.tokens >= 1 {
-		bucket.tokens--
-		return true
+// LoadBalancer.SetConcurrency applies the pool's static and adaptive
+// per-backend concurrency limits, either of which may be nil for none
+func (lb *LoadBalancer) SetConcurrency(cc *ConcurrencyConfig, ac *AdaptiveConcurrencyConfig) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	for _, b := range lb.backends {
+		b.queue.Configure(cc)
+		b.adaptive.Configure(ac)
 	}
-	return false
 }
 
-func (rl *RateLimiter) allowKey(key string, limit int) bool {
-	bucket, exists := rl.keyLimits[key]
-	if !exists {
-		bucket = &TokenBucket{
-			tokens:     float64(limit),
-			capacity:   float64(limit),
-			refillRate: float64(limit) / 60.0,
-			lastRefill: time.Now(),
-		}
-		rl.keyLimits[key] = bucket
-	}
+// LoadBalancer.BreakersOpen reports whether any alive backend is held back
+// by its circuit breaker
+func (lb *LoadBalancer) BreakersOpen() bool {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
 
-	bucket.refill()
-	if bucket.tokens >= 1 {
-		bucket.tokens--
-		return true
+	if lb.breaker == nil {
+		return false
+	}
+	now := time.Now()
+	for _, b := range lb.backends {
+		if b.IsAlive() && !lb.breaker.allows(b, now) {
+			return true
+		}
 	}
 	return false
 }
 
-// TokenBucket.refill adds tokens based on time elapsed
-func (tb *TokenBucket) refill() {
-	now := time.Now()
-	elapsed := now.Sub(tb.lastRefill).Seconds()
-	tb.tokens = min(tb.capacity, tb.tokens+elapsed*tb.refillRate)
-	tb.lastRefill = now
+// LoadBalancer.SetStrategy switches the balancing strategy
+func (lb *LoadBalancer) SetStrategy(strategy Strategy) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	lb.strategy = strategy
+	lb.buildRing()
 }
 
-func min(a, b float64) float64 {
-	if a < b {
-		return a
+// ringBuilder is a strategy that places backends on a ring built from the
+// pool's whole backend set
+type ringBuilder interface {
+	build(backends []*Backend)
+}
+
+// buildRing rebuilds the strategy's ring, if it has one, for the current
+// backends and weights. The caller holds lb.mu.
+func (lb *LoadBalancer) buildRing() {
+	if rb, ok := lb.strategy.(ringBuilder); ok {
+		rb.build(lb.backends)
 	}
-	return b
 }
 
-// healthCheckLoop periodically checks backend health
-func (g *Gateway) healthCheckLoop() {
-	ticker := time.NewTicker(g.config.HealthCheckInterval)
-	defer ticker.Stop()
+// LoadBalancer.URLs returns the backend URLs
+func (lb *LoadBalancer) URLs() []string {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+
+	urls := make([]string, len(lb.backends))
+	for i, b := range lb.backends {
+		urls[i] = b.URL.String()
+	}
+	return urls
+}
+
+// LoadBalancer.SetBackends replaces the backend set, keeping the existing
+// Backend (and its health state) for URLs that are still present and
+// applying their new weight
+func (lb *LoadBalancer) SetBackends(backends []*Backend) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
 
-	for range ticker.C {
-		g.lb.mu.Lock()
-		backends := make([]*Backend, len(g.lb.backends))
-		copy(backends, g.lb.backends)
-		g.lb.mu.Unlock()
+	existing := make(map[string]*Backend, len(lb.backends))
+	for _, b := range lb.backends {
+		existing[b.URL.String()] = b
+	}
 
-		for _, backend := range backends {
-			go g.checkBackendHealth(backend)
+	for i, b := range backends {
+		if old, ok := existing[b.URL.String()]; ok {
+			old.Weight = b.Weight
+			backends[i] = old
 		}
 	}
+
+	// Restart the weighted round-robin sequence with the new weights
+	for _, b := range backends {
+		b.currentWeight = 0
+	}
+
+	lb.backends = backends
+	lb.buildRing()
 }
 
-// checkBackendHealth performs a health check on a backend
-func (g *Gateway) checkBackendHealth(backend *Backend) {
-	healthURL := fmt.Sprintf("%s/health", backend.URL.String())
+// healthCheckLoop starts each backend's health check when it is due. Pools
+// have their own intervals, and backends added by a reload are checked on
+// the next tick.
+func (g *Gateway) healthCheckLoop() {
+	ticker := time.NewTicker(healthCheckTick)
+	defer ticker.Stop()
 
-	client := &http.Client{
-		Timeout: 5 * time.Second,
+	for {
+		var now time.Time
+		select {
+		case now = <-ticker.C:
+		case <-g.stop:
+			return
+		}
+
+		for _, pool := range g.currentRouter().Pools() {
+			pool.LB.mu.Lock()
+			backends := make([]*Backend, len(pool.LB.backends))
+			copy(backends, pool.LB.backends)
+			pool.LB.mu.Unlock()
+
+			for _, backend := range backends {
+				backend.mu.Lock()
+				due := !backend.checking && !now.Before(backend.nextCheck)
+				if due {
+					backend.checking = true
+					backend.nextCheck = pool.Health.next(now)
+				}
+				backend.mu.Unlock()
+
+				if due {
+					go g.checkBackendHealth(backend, pool.Health)
+				}
+			}
+		}
 	}
+}
 
-	resp, err := client.Get(healthURL)
+// checkBackendHealth performs a health check on a backend. The backend
+// changes state only after hc.Fall consecutive failures or hc.Rise
+// consecutive successes.
+func (g *Gateway) checkBackendHealth(backend *Backend, hc *HealthCheck) {
+	err := hc.probe(backend)
 
 	backend.mu.Lock()
-	wasAlive := backend.Alive
+	defer backend.mu.Unlock()
+	backend.checking = false
 
-	if err != nil || (resp != nil && resp.StatusCode != http.StatusOK) {
-		backend.Alive = false
-		if wasAlive {
-			log.Printf("Backend %s is now unhealthy", backend.URL.String())
+	if err != nil {
+		backend.failures++
+		backend.successes = 0
+		if backend.Alive && backend.failures >= hc.Fall {
+			backend.Alive = false
+			log.Printf("Backend %s is now unhealthy: %v", backend.URL.String(), err)
 		}
 	} else {
-		backend.Alive = true
-		if !wasAlive {
+		backend.successes++
+		backend.failures = 0
+		if !backend.Alive && backend.successes >= hc.Rise {
+			backend.Alive = true
 			log.Printf("Backend %s is now healthy", backend.URL.String())
 		}
 	}
-	backend.mu.Unlock()
-
-	if resp != nil {
-		resp.Body.Close()
-	}
 }
 
 // RequestLogger.Log logs a request entry
@@ -413,13 +856,41 @@ func (rl *RequestLogger) Log(entry LogEntry) {
 	rl.file.WriteString(string(data) + "\n")
 }
 
+// RequestLogger.Reopen switches logging to a different file
+func (rl *RequestLogger) Reopen(path string) error {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	rl.mu.Lock()
+	old := rl.file
+	rl.file = file
+	rl.mu.Unlock()
+
+	return old.Close()
+}
+
 // Close closes the gateway
 func (g *Gateway) Close() error {
-	return g.logger.file.Close()
+	return g.logger.Close()
+}
+
+// RequestLogger.Close flushes the log file to disk and closes it
+func (rl *RequestLogger) Close() error {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	if err := rl.file.Sync(); err != nil {
+		rl.file.Close()
+		return err
+	}
+	return rl.file.Close()
 }
 
 func main() {
 	mode := flag.String("mode", "gateway", "gateway, backend, or client")
+	configPath := flag.String("config", "", "Gateway config file (YAML or JSON)")
 	port := flag.Int("port", 8080, "Port (gateway: 8080, backend: 8081+)")
 	backends := flag.String("backends", "http://localhost:8081,http://localhost:8082", "Comma-separated backend URLs")
 	rateLimit := flag.Int("rate-limit", 100, "Requests per minute per IP")
@@ -433,27 +904,43 @@ func main() {
 	case "client":
 		clientMain()
 	default:
-		runGateway(*port, *backends, *rateLimit, *keyRateLimit)
+		runGateway(*configPath, *port, *backends, *rateLimit, *keyRateLimit)
 	}
 }
 
-func runGateway(port int, backendsStr string, rateLimit, keyRateLimit int) {
-	// Create API keys
-	apiKeys := make(map[string]bool)
-	apiKeys["key-test-1"] = true
-	apiKeys["key-test-2"] = true
-	apiKeys["key-admin"] = true
-
-	// Parse backends
-	backendsList := strings.Split(backendsStr, ",")
+func runGateway(configPath string, port int, backendsStr string, rateLimit, keyRateLimit int) {
+	load := func() (*Config, error) {
+		config := DefaultConfig()
+		if configPath != "" {
+			var err error
+			config, err = LoadConfig(configPath)
+			if err != nil {
+				return nil, err
+			}
+		}
 
-	config := &Config{
-		Port:                port,
-		Backends:            backendsList,
-		RateLimitPerIP:      rateLimit,
-		RateLimitPerKey:     keyRateLimit,
-		HealthCheckInterval: 10 * time.Second,
-		APIKeys:             apiKeys,
+		// Explicitly set flags override the config file
+		flag.Visit(func(f *flag.Flag) {
+			switch f.Name {
+			case "port":
+				config.ListenAddr = fmt.Sprintf(":%d", port)
+			case "backends":
+				config.Backends = nil
+				for _, backendURL := range strings.Split(backendsStr, ",") {
+					config.Backends = append(config.Backends, BackendConfig{URL: backendURL, Weight: 1})
+				}
+			case "rate-limit":
+				config.RateLimitPerIP = rateLimit
+			case "key-rate-limit":
+				config.RateLimitPerKey = keyRateLimit
+			}
+		})
+		return config, nil
+	}
+
+	config, err := load()
+	if err != nil {
+		log.Fatalf("Failed to load config: %v", err)
 	}
 
 	gateway, err := NewGateway(config)
@@ -461,9 +948,44 @@ func runGateway(port int, backendsStr string, rateLimit, keyRateLimit int) {
 		log.Fatalf("Failed to create gateway: %v", err)
 	}
 
-	if err := gateway.Start(); err != nil {
-		log.Fatalf("Gateway error: %v", err)
+	if configPath != "" {
+		go gateway.WatchConfig(configPath, load)
+	}
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- gateway.Start()
+	}()
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, os.Interrupt)
+	upgrade := make(chan os.Signal, 1)
+	notifyUpgrade(upgrade)
+
+	for {
+		select {
+		case err := <-errc:
+			log.Fatalf("Gateway error: %v", err)
+		case sig := <-stop:
+			log.Printf("Received %v, shutting down", sig)
+			signal.Stop(stop)
+			if err := gateway.Shutdown(); err != nil {
+				log.Fatalf("Shutdown error: %v", err)
+			}
+		case <-upgrade:
+			log.Printf("Received SIGUSR2, upgrading")
+			if err := gateway.Upgrade(); err != nil {
+				log.Printf("Upgrade failed, continuing to serve: %v", err)
+				continue
+			}
+			signal.Stop(stop)
+			if err := gateway.drain(); err != nil {
+				log.Fatalf("Shutdown error: %v", err)
+			}
+		}
+		break
 	}
+	log.Printf("Gateway stopped")
 }
 
 func runBackend(port int, name string) {
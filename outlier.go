@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+)
+
+// Outlier detection defaults, used for fields left unset
+const (
+	defaultConsecutive5xx            = 5
+	defaultConsecutiveGatewayFailure = 3
+	defaultBaseEjectionTime          = 30 * time.Second
+	defaultMaxEjectionTime           = 5 * time.Minute
+	defaultMaxEjectionPercent        = 50
+	defaultLatencyMin                = 100 * time.Millisecond
+)
+
+// OutlierDetection ejects backends that misbehave on live traffic, without
+// waiting for the next active health check. An ejected backend gets no
+// requests until its ejection time passes; each repeat ejection doubles that
+// time up to MaxEjectionTime.
+type OutlierDetection struct {
+	Consecutive5xx            int
+	ConsecutiveGatewayFailure int
+	LatencyFactor             float64
+	LatencyMin                time.Duration
+	BaseEjectionTime          time.Duration
+	MaxEjectionTime           time.Duration
+	MaxEjectionPercent        int
+}
+
+// newOutlierDetection builds a pool's outlier detection from its config.
+// It returns nil when the pool has none configured.
+func newOutlierDetection(oc *OutlierConfig) *OutlierDetection {
+	if oc == nil {
+		return nil
+	}
+
+	od := &OutlierDetection{
+		Consecutive5xx:            oc.Consecutive5xx,
+		ConsecutiveGatewayFailure: oc.ConsecutiveGatewayFailure,
+		LatencyFactor:             oc.LatencyFactor,
+		LatencyMin:                oc.LatencyMin,
+		BaseEjectionTime:          oc.BaseEjectionTime,
+		MaxEjectionTime:           oc.MaxEjectionTime,
+		MaxEjectionPercent:        oc.MaxEjectionPercent,
+	}
+	if od.Consecutive5xx == 0 {
+		od.Consecutive5xx = defaultConsecutive5xx
+	}
+	if od.ConsecutiveGatewayFailure == 0 {
+		od.ConsecutiveGatewayFailure = defaultConsecutiveGatewayFailure
+	}
+	if od.LatencyMin == 0 {
+		od.LatencyMin = defaultLatencyMin
+	}
+	if od.BaseEjectionTime == 0 {
+		od.BaseEjectionTime = defaultBaseEjectionTime
+	}
+	if od.MaxEjectionTime == 0 {
+		od.MaxEjectionTime = defaultMaxEjectionTime
+	}
+	if od.MaxEjectionPercent == 0 {
+		od.MaxEjectionPercent = defaultMaxEjectionPercent
+	}
+	return od
+}
+
+// OutlierDetection.Observe records the outcome of a proxied request and
+// ejects the backend if it has become an outlier. Gateway failures are
+// transport errors such as refused connections; 5xx counts any 5xx status.
+// Requests cancelled by the client say nothing about the backend and are
+// ignored.
+func (od *OutlierDetection) Observe(lb *LoadBalancer, b *Backend, res ProxyResult) {
+	if errors.Is(res.Err, context.Canceled) {
+		return
+	}
+
+	b.mu.Lock()
+	if res.Err != nil {
+		b.gatewayFailures++
+	} else {
+		b.gatewayFailures = 0
+	}
+	if res.Err != nil || res.Status >= 500 {
+		b.consecutive5xx++
+	} else {
+		b.consecutive5xx = 0
+	}
+
+	var reason string
+	switch {
+	case b.gatewayFailures >= od.ConsecutiveGatewayFailure:
+		reason = fmt.Sprintf("%d consecutive gateway failures (%v)", b.gatewayFailures, res.Err)
+	case b.consecutive5xx >= od.Consecutive5xx:
+		reason = fmt.Sprintf("%d consecutive 5xx responses", b.consecutive5xx)
+	}
+	latency := time.Duration(b.ewma)
+	b.mu.Unlock()
+
+	if reason == "" && od.LatencyFactor > 0 && latency >= od.LatencyMin {
+		if median := lb.medianLatency(b); median > 0 && float64(latency) > od.LatencyFactor*float64(median) {
+			reason = fmt.Sprintf("latency %v is over %gx the pool median %v", latency.Round(time.Millisecond), od.LatencyFactor, median.Round(time.Millisecond))
+		}
+	}
+
+	if reason != "" {
+		od.eject(lb, b, reason)
+	}
+}
+
+// eject takes b out of rotation unless that would eject more than
+// MaxEjectionPercent of the pool. One backend may always be ejected from a
+// pool of two or more.
+func (od *OutlierDetection) eject(lb *LoadBalancer, b *Backend, reason string) {
+	now := time.Now()
+
+	lb.mu.Lock()
+	total, ejected := len(lb.backends), 0
+	for _, other := range lb.backends {
+		if other != b && other.Ejected(now) {
+			ejected++
+		}
+	}
+	lb.mu.Unlock()
+
+	allowed := total * od.MaxEjectionPercent / 100
+	if allowed < 1 && total >= 2 {
+		allowed = 1
+	}
+	if ejected+1 > allowed {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if now.Before(b.ejectedUntil) {
+		return
+	}
+
+	// Forget old ejections once the backend has behaved for a while
+	if now.Sub(b.ejectedUntil) > od.MaxEjectionTime {
+		b.ejections = 0
+	}
+	b.ejections++
+
+	duration := od.BaseEjectionTime << (b.ejections - 1)
+	if duration > od.MaxEjectionTime || duration <= 0 {
+		duration = od.MaxEjectionTime
+	}
+	b.ejectedUntil = now.Add(duration)
+	b.consecutive5xx = 0
+	b.gatewayFailures = 0
+
+	// Start fresh on return rather than being judged on stale latency
+	b.ewma = 0
+
+	log.Printf("Backend %s ejected for %v: %s", b.URL.String(), duration, reason)
+}
+
+// Backend.Ejected reports whether outlier detection has taken the backend
+// out of rotation
+func (b *Backend) Ejected(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return now.Before(b.ejectedUntil)
+}
+
+// LoadBalancer.medianLatency returns the median latency of the pool's other
+// alive backends, or 0 if fewer than two have latency samples
+func (lb *LoadBalancer) medianLatency(exclude *Backend) time.Duration {
+	lb.mu.Lock()
+	backends := make([]*Backend, len(lb.backends))
+	copy(backends, lb.backends)
+	lb.mu.Unlock()
+
+	var latencies []time.Duration
+	for _, b := range backends {
+		if b == exclude || !b.IsAlive() {
+			continue
+		}
+		if l := b.Latency(); l > 0 {
+			latencies = append(latencies, l)
+		}
+	}
+	if len(latencies) < 2 {
+		return 0
+	}
+
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	return latencies[len(latencies)/2]
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestMedianLatencyHealthRace flips backend health the way the health
+// checker does while the median is computed; run with -race
+func TestMedianLatencyHealthRace(t *testing.T) {
+	router := testRouter(t, `
+backends:
+  - http://localhost:8081
+  - http://localhost:8082
+  - http://localhost:8083
+`)
+	lb := router.pools[defaultPool].LB
+	for i, b := range lb.backends {
+		b.observeLatency(time.Duration(i+1) * 10 * time.Millisecond)
+	}
+
+	started, stop := make(chan struct{}), make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		b := lb.backends[1]
+		close(started)
+		for {
+			select {
+			case <-stop:
+				b.mu.Lock()
+				b.Alive = true
+				b.mu.Unlock()
+				return
+			default:
+			}
+			b.mu.Lock()
+			b.Alive = !b.Alive
+			b.mu.Unlock()
+		}
+	}()
+	<-started
+	for i := 0; i < 1000; i++ {
+		lb.medianLatency(lb.backends[0])
+	}
+	close(stop)
+	wg.Wait()
+
+	if got := lb.medianLatency(lb.backends[0]); got != 30*time.Millisecond {
+		t.Errorf("median = %v, want 30ms", got)
+	}
+}
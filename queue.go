@@ -0,0 +1,300 @@
+package main
+
+import (
+	"container/heap"
+	"context"
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Concurrency limit defaults
+const defaultQueueMaxWait = time.Second
+
+// queueWaitWindow is how many seconds of queue waits Bulkhead.WaitStats
+// covers
+const queueWaitWindow = 60
+
+// statusClientClosedRequest is logged for requests whose client went away
+// before there was anything to send, following nginx
+const statusClientClosedRequest = 499
+
+var (
+	errQueueFull    = errors.New("concurrency limit reached and queue full")
+	errQueueTimeout = errors.New("timed out waiting in queue")
+)
+
+// Bulkhead caps the requests in flight to a backend or route. Requests over
+// Limit wait in a queue of up to Queue entries, highest priority first and
+// FIFO within a priority, for at most MaxWait. A zero Limit means no limit.
+type Bulkhead struct {
+	Limit   int
+	Queue   int
+	MaxWait time.Duration
+
+	inFlight int
+	waiters  waiterHeap
+	seq      uint64
+	waits    [queueWaitWindow]waitBucket
+	mu       sync.Mutex
+}
+
+// waitBucket sums the waits of requests that left a Bulkhead's queue in one
+// second
+type waitBucket struct {
+	second int64
+	count  int
+	total  time.Duration
+	max    time.Duration
+}
+
+// waiter is a request queued in a Bulkhead
+type waiter struct {
+	priority int
+	seq      uint64
+	ready    chan struct{}
+	index    int // position in the heap, -1 once granted a slot
+}
+
+// waiterHeap orders waiters by priority, then arrival
+type waiterHeap []*waiter
+
+func (h waiterHeap) Len() int { return len(h) }
+
+func (h waiterHeap) Less(i, j int) bool {
+	if h[i].priority != h[j].priority {
+		return h[i].priority > h[j].priority
+	}
+	return h[i].seq < h[j].seq
+}
+
+func (h waiterHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *waiterHeap) Push(x interface{}) {
+	w := x.(*waiter)
+	w.index = len(*h)
+	*h = append(*h, w)
+}
+
+func (h *waiterHeap) Pop() interface{} {
+	old := *h
+	w := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	w.index = -1
+	return w
+}
+
+// newBulkhead builds a route's bulkhead from its config. It returns nil when
+// the route has no concurrency limit.
+func newBulkhead(cc *ConcurrencyConfig) *Bulkhead {
+	if cc == nil || cc.Max == 0 {
+		return nil
+	}
+	bh := &Bulkhead{}
+	bh.Configure(cc)
+	return bh
+}
+
+// Bulkhead.Configure applies new limits. Requests already in flight or
+// queued keep their place, and waiters that now fit are let through.
+func (bh *Bulkhead) Configure(cc *ConcurrencyConfig) {
+	bh.mu.Lock()
+	defer bh.mu.Unlock()
+
+	bh.Limit, bh.MaxWait = 0, 0
+	if cc != nil {
+		bh.Limit, bh.MaxWait = cc.Max, cc.MaxWait
+	}
+	bh.Queue = bh.Limit
+	if cc != nil && cc.Queue != nil {
+		bh.Queue = *cc.Queue
+	}
+	if bh.MaxWait == 0 {
+		bh.MaxWait = defaultQueueMaxWait
+	}
+
+	for len(bh.waiters) > 0 && (bh.Limit == 0 || bh.inFlight < bh.Limit) {
+		bh.grant()
+	}
+}
+
+// Bulkhead.Acquire takes a slot, queueing if the bulkhead is full. It
+// returns how long the request waited and the queue depth it joined at.
+// On success the caller must call Release.
+func (bh *Bulkhead) Acquire(ctx context.Context, priority int) (time.Duration, int, error) {
+	bh.mu.Lock()
+	if bh.Limit == 0 || (bh.inFlight < bh.Limit && len(bh.waiters) == 0) {
+		bh.inFlight++
+		bh.mu.Unlock()
+		return 0, 0, nil
+	}
+	if len(bh.waiters) >= bh.Queue {
+		depth := len(bh.waiters)
+		bh.mu.Unlock()
+		return 0, depth, errQueueFull
+	}
+
+	bh.seq++
+	w := &waiter{priority: priority, seq: bh.seq, ready: make(chan struct{})}
+	heap.Push(&bh.waiters, w)
+	depth := len(bh.waiters)
+	maxWait := bh.MaxWait
+	bh.mu.Unlock()
+
+	start := time.Now()
+	timer := time.NewTimer(maxWait)
+	defer timer.Stop()
+
+	var err error
+	select {
+	case <-w.ready:
+	case <-timer.C:
+		err = errQueueTimeout
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	now := time.Now()
+	wait := now.Sub(start)
+
+	bh.mu.Lock()
+	defer bh.mu.Unlock()
+	if w.index < 0 {
+		// Granted a slot, perhaps just as the wait ended
+		bh.recordWait(now, wait)
+		return wait, depth, nil
+	}
+	heap.Remove(&bh.waiters, w.index)
+	// A client that gave up says nothing about how long the queue is
+	if !errors.Is(err, context.Canceled) {
+		bh.recordWait(now, wait)
+	}
+	return wait, depth, err
+}
+
+// recordWait counts a request that left the queue after waiting wait. The
+// caller holds bh.mu.
+func (bh *Bulkhead) recordWait(now time.Time, wait time.Duration) {
+	second := now.Unix()
+	b := &bh.waits[second%queueWaitWindow]
+	if b.second != second {
+		*b = waitBucket{second: second}
+	}
+	b.count++
+	b.total += wait
+	if wait > b.max {
+		b.max = wait
+	}
+}
+
+// Bulkhead.Release returns a slot, handing it to the next waiter if any
+func (bh *Bulkhead) Release() {
+	bh.mu.Lock()
+	defer bh.mu.Unlock()
+
+	bh.inFlight--
+	if len(bh.waiters) > 0 && (bh.Limit == 0 || bh.inFlight < bh.Limit) {
+		bh.grant()
+	}
+}
+
+// grant gives a slot to the first waiter. The caller holds bh.mu.
+func (bh *Bulkhead) grant() {
+	w := heap.Pop(&bh.waiters).(*waiter)
+	bh.inFlight++
+	close(w.ready)
+}
+
+// Bulkhead.Stats returns the requests in flight and queued
+func (bh *Bulkhead) Stats() (inFlight, queued int) {
+	bh.mu.Lock()
+	defer bh.mu.Unlock()
+	return bh.inFlight, len(bh.waiters)
+}
+
+// Bulkhead.WaitStats returns how many requests left the queue in the last
+// queueWaitWindow seconds, and their average and longest wait
+func (bh *Bulkhead) WaitStats() (count int, avg, max time.Duration) {
+	bh.mu.Lock()
+	defer bh.mu.Unlock()
+
+	second := time.Now().Unix()
+	var total time.Duration
+	for _, b := range bh.waits {
+		if second-b.second < queueWaitWindow {
+			count += b.count
+			total += b.total
+			if b.max > max {
+				max = b.max
+			}
+		}
+	}
+	if count > 0 {
+		avg = total / time.Duration(count)
+	}
+	return count, avg, max
+}
+
+// Bulkhead.waitStatus describes recent queue waits for /health
+func (bh *Bulkhead) waitStatus() map[string]interface{} {
+	count, avg, max := bh.WaitStats()
+	return map[string]interface{}{
+		"requests": count,
+		"avg_ms":   float64(avg.Microseconds()) / 1000,
+		"max_ms":   float64(max.Microseconds()) / 1000,
+	}
+}
+
+// Bulkhead.RetryAfter returns how long a rejected client should wait before
+// trying again
+func (bh *Bulkhead) RetryAfter() time.Duration {
+	bh.mu.Lock()
+	defer bh.mu.Unlock()
+	return bh.MaxWait
+}
+
+// isOverloaded reports whether err means a bulkhead or adaptive limiter
+// turned the request away
+func isOverloaded(err error) bool {
+	return errors.Is(err, errQueueFull) || errors.Is(err, errQueueTimeout) || errors.Is(err, errLimitExceeded)
+}
+
+// writeOverloaded replies 503 with a JSON error and a Retry-After of
+// retryAfter rounded up to whole seconds
+func writeOverloaded(w http.ResponseWriter, retryAfter time.Duration, err error) {
+	seconds := int(math.Ceil(retryAfter.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	w.WriteHeader(http.StatusServiceUnavailable)
+	json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+}
+
+// priorityKey carries a request's queue priority in its context
+type priorityKey struct{}
+
+// withPriority returns ctx carrying a queue priority
+func withPriority(ctx context.Context, priority int) context.Context {
+	return context.WithValue(ctx, priorityKey{}, priority)
+}
+
+// requestPriority returns the queue priority carried by ctx, or 0
+func requestPriority(ctx context.Context) int {
+	priority, _ := ctx.Value(priorityKey{}).(int)
+	return priority
+}
+
+// formatMillis formats d as milliseconds for log entries
+func formatMillis(d time.Duration) string {
+	return strconv.FormatFloat(float64(d.Microseconds())/1000, 'f', 2, 64)
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// TestBulkheadQueueSize checks that a route's queue defaults to max and
+// that zero turns the excess away without queueing
+func TestBulkheadQueueSize(t *testing.T) {
+	tests := []struct {
+		name  string
+		queue string
+		want  int
+	}{
+		{"default", "", 2},
+		{"zero", "queue: 0", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			router := testRouter(t, `
+backends: [http://localhost:8081]
+routes:
+  - path_prefix: /
+    pool: default
+    concurrency:
+      max: 2
+      max_wait: 1m
+      `+tt.queue+`
+`)
+			bh := router.routes[0].Queue
+			if bh.Queue != tt.want {
+				t.Errorf("Queue = %d, want %d", bh.Queue, tt.want)
+			}
+			for i := 0; i < 2; i++ {
+				if _, _, err := bh.Acquire(context.Background(), 0); err != nil {
+					t.Fatalf("request %d: %v", i+1, err)
+				}
+			}
+			if tt.want > 0 {
+				return
+			}
+			start := time.Now()
+			if _, _, err := bh.Acquire(context.Background(), 0); !errors.Is(err, errQueueFull) {
+				t.Errorf("request over max: err = %v, want %v", err, errQueueFull)
+			}
+			if waited := time.Since(start); waited > 100*time.Millisecond {
+				t.Errorf("request over max waited %v", waited)
+			}
+		})
+	}
+}
+
+// TestBulkheadCancelledWait checks that a client giving up while queued
+// isn't counted in the queue wait stats
+func TestBulkheadCancelledWait(t *testing.T) {
+	bh := newBulkhead(&ConcurrencyConfig{Max: 1, MaxWait: time.Minute})
+	if _, _, err := bh.Acquire(context.Background(), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, _, err := bh.Acquire(ctx, 0); !isTimeout(err) {
+		t.Fatalf("err = %v, want a timeout", err)
+	}
+	ctx, cancel = context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+	if _, _, err := bh.Acquire(ctx, 0); !errors.Is(err, context.Canceled) {
+		t.Fatalf("err = %v, want %v", err, context.Canceled)
+	}
+
+	if count, _, _ := bh.WaitStats(); count != 1 {
+		t.Errorf("%d waits counted, want only the timed out one", count)
+	}
+	if _, queued := bh.Stats(); queued != 0 {
+		t.Errorf("%d requests left queued", queued)
+	}
+}
@@ -0,0 +1,397 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// defaultRateLimitMaxClients bounds the buckets each limiter tracks
+	defaultRateLimitMaxClients = 100000
+
+	// rateLimitShards is the number of independently locked shards per
+	// limiter
+	rateLimitShards = 64
+
+	// rateLimitSweepInterval is how often a shard drops idle clients
+	rateLimitSweepInterval = 10 * time.Second
+)
+
+// RateLimiter implements per-IP and per-key rate limiting. Buckets counted
+// by IP and by API key are kept in separate local stores. When Redis is
+// configured it holds the state instead, and the local stores are only used
+// while it is unreachable.
+type RateLimiter struct {
+	ips    bucketStore
+	keys   bucketStore
+	remote atomic.Pointer[redisStore]
+	mu     sync.Mutex
+}
+
+// RateLimitPolicy allows each client Requests per Window, with bursts of up
+// to Burst. It applies gateway-wide, to a route or to an API key.
+type RateLimitPolicy struct {
+	// Name identifies the policy to clients; id keeps its buckets apart
+	// from other policies'
+	Name       string
+	id         string
+	Requests   int
+	Window     time.Duration
+	Burst      int
+	Algorithm  string
+	PerKey     bool
+	Methods    []string
+	PathPrefix string
+}
+
+// RateLimitResult is the outcome of a rate limit check, describing the
+// limit closest to being exhausted
+type RateLimitResult struct {
+	Allowed bool
+	// Scope is what the policy counted, "ip" or "key"
+	Scope     string
+	Policy    *RateLimitPolicy
+	Limit     int
+	Remaining int
+	// Reset is how long until the bucket is full again
+	Reset time.Duration
+	// RetryAfter is how long until the next token, when not allowed
+	RetryAfter time.Duration
+}
+
+// bucketStore holds each client's Limiter state. It is split into shards so
+// clients don't contend on one lock, and each shard is bounded: idle state
+// is dropped, since a new client's would be identical, and past its share
+// of the limit the least recently used client is evicted.
+type bucketStore struct {
+	shards [rateLimitShards]bucketShard
+}
+
+// bucketShard is one lock's worth of buckets, most recently used first
+type bucketShard struct {
+	mu        sync.Mutex
+	buckets   map[string]*list.Element
+	lru       list.List
+	lastSweep time.Time
+}
+
+// bucketEntry is a client's limiter state and the algorithm it is for
+type bucketEntry struct {
+	client    string
+	algorithm string
+	limiter   Limiter
+}
+
+// newRateLimitPolicy builds a policy from its config, filling in the
+// default window, burst and algorithm
+func newRateLimitPolicy(id, name string, pc RateLimitPolicyConfig) *RateLimitPolicy {
+	p := &RateLimitPolicy{
+		Name:       name,
+		id:         id,
+		Requests:   pc.Requests,
+		Window:     pc.Window,
+		Burst:      pc.Burst,
+		Algorithm:  pc.Algorithm,
+		PerKey:     pc.Per == "key",
+		Methods:    pc.Methods,
+		PathPrefix: pc.PathPrefix,
+	}
+	if p.Window == 0 {
+		p.Window = time.Minute
+	}
+	if p.Burst == 0 {
+		p.Burst = p.Requests
+	}
+	if p.Algorithm == "" {
+		p.Algorithm = algorithmTokenBucket
+	}
+	return p
+}
+
+// policyIDs returns ids for the policies configured on owner, a route's
+// match conditions or an API key. They are derived from the owner and each
+// policy's settings rather than positions in the file, so clients keep
+// their buckets when a reload reorders routes, keys or policies, and start
+// afresh when a policy is edited. Identical policies on one owner are
+// numbered apart. The ids end up in Redis keys, so they are hashed to keep
+// API keys out.
+func policyIDs(owner string, pcs []RateLimitPolicyConfig) []string {
+	ids := make([]string, len(pcs))
+	seen := make(map[string]int)
+	for i, pc := range pcs {
+		content := fmt.Sprintf("%s\x00%+v", owner, pc)
+		sum := sha256.Sum256([]byte(fmt.Sprintf("%s\x00%d", content, seen[content])))
+		ids[i] = hex.EncodeToString(sum[:8])
+		seen[content]++
+	}
+	return ids
+}
+
+// perMinute returns a gateway-wide policy of limit requests per minute
+func perMinute(id string, limit int, algorithm string, perKey bool) *RateLimitPolicy {
+	p := newRateLimitPolicy(id, "default", RateLimitPolicyConfig{
+		Requests:  limit,
+		Algorithm: algorithm,
+	})
+	p.PerKey = perKey
+	return p
+}
+
+// RateLimitPolicy.Match reports whether the policy counts r
+func (p *RateLimitPolicy) Match(r *http.Request) bool {
+	if p.PathPrefix != "" && !hasPathPrefix(r.URL.Path, p.PathPrefix) {
+		return false
+	}
+	if len(p.Methods) == 0 {
+		return true
+	}
+	for _, method := range p.Methods {
+		if r.Method == method {
+			return true
+		}
+	}
+	return false
+}
+
+// RateLimitPolicy.rate returns the sustained rate in requests per second
+func (p *RateLimitPolicy) rate() float64 {
+	return float64(p.Requests) / p.Window.Seconds()
+}
+
+// RateLimiter.Allow checks if request is allowed under the gateway-wide IP
+// limit, the key's own policies or else the gateway-wide key limit, and the
+// route's policies. It stops at the first policy that rejects the request
+// and reports it, or else the policy with the fewest requests remaining.
+func (rl *RateLimiter) Allow(r *http.Request, ip, key string, route *Route, config *Config) RateLimitResult {
+	now := time.Now()
+	var result RateLimitResult
+	check := func(p *RateLimitPolicy) bool {
+		if !p.Match(r) {
+			return true
+		}
+		client, scope := ip, "ip"
+		if p.PerKey && key != "" {
+			client, scope = key, "key"
+		}
+
+		res := rl.take(r.Context(), scope, client, p, config.RateLimitMaxClients, now)
+		res.Scope, res.Policy = scope, p
+		if !res.Allowed || result.Policy == nil || res.Remaining < result.Remaining {
+			result = res
+		}
+		return res.Allowed
+	}
+
+	// Check IP limit
+	if !check(perMinute("ip", config.RateLimitPerIP, config.RateLimitAlgorithm, false)) {
+		return result
+	}
+
+	// Check key limits
+	if key != "" {
+		policies := config.KeyRateLimits[key]
+		if len(policies) == 0 {
+			policies = []*RateLimitPolicy{perMinute("key", config.RateLimitPerKey, config.RateLimitAlgorithm, true)}
+		}
+		for _, p := range policies {
+			if !check(p) {
+				return result
+			}
+		}
+	}
+
+	// Check route limits
+	if route != nil {
+		for _, p := range route.RateLimits {
+			if !check(p) {
+				return result
+			}
+		}
+	}
+	return result
+}
+
+// RateLimiter.take admits a request from client under p, in Redis when it is
+// configured and available and otherwise in the local store for scope
+func (rl *RateLimiter) take(ctx context.Context, scope, client string, p *RateLimitPolicy, maxClients int, now time.Time) RateLimitResult {
+	if remote := rl.remote.Load(); remote != nil && remote.Available(now) {
+		id := client
+		if scope == "key" {
+			id = redisClientKey(client)
+		}
+		result, err := remote.Take(ctx, scope+":"+p.id+":"+id, p, now)
+		if err == nil {
+			return result
+		}
+		// A client that went away is not a Redis failure
+		if ctx.Err() == nil {
+			remote.Failed(now, err)
+		}
+	}
+
+	store := &rl.ips
+	if scope == "key" {
+		store = &rl.keys
+	}
+	return store.Take(p.id+"\x00"+client, p, maxClients, now)
+}
+
+// RateLimiter.Configure switches to the Redis server in config, or back to
+// local state when none is configured. An unchanged server keeps its
+// connections.
+func (rl *RateLimiter) Configure(config *Config) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	old := rl.remote.Load()
+	rc := config.RateLimitRedis
+	if old != nil && rc != nil && *rc == old.config {
+		return
+	}
+	if old == nil && rc == nil {
+		return
+	}
+
+	var remote *redisStore
+	if rc != nil {
+		remote = newRedisStore(*rc)
+		log.Printf("Rate limiting with Redis at %s", rc.Address)
+	}
+	rl.remote.Store(remote)
+	if old != nil {
+		old.Close()
+	}
+}
+
+// RateLimiter.Status describes the Redis store for /health, or returns nil
+// when rate limiting is local
+func (rl *RateLimiter) Status() map[string]interface{} {
+	remote := rl.remote.Load()
+	if remote == nil {
+		return nil
+	}
+	return map[string]interface{}{
+		"address":   remote.config.Address,
+		"available": !remote.down.Load(),
+	}
+}
+
+// setRateLimitHeaders adds the IETF draft RateLimit-* headers describing
+// result to the response
+func setRateLimitHeaders(w http.ResponseWriter, result RateLimitResult) {
+	h := w.Header()
+	h.Set("RateLimit-Limit", strconv.Itoa(result.Limit))
+	h.Set("RateLimit-Remaining", strconv.Itoa(result.Remaining))
+	h.Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(result.Reset)))
+	if p := result.Policy; p != nil {
+		h.Set("RateLimit-Policy", fmt.Sprintf("%d;w=%d;burst=%d", p.Requests, ceilSeconds(p.Window), p.Burst))
+	}
+}
+
+// writeRateLimited writes a 429 naming the limit that was hit
+func writeRateLimited(w http.ResponseWriter, result RateLimitResult) {
+	retryAfter := max(1, ceilSeconds(result.RetryAfter))
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	w.WriteHeader(http.StatusTooManyRequests)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error":       "rate limit exceeded",
+		"scope":       result.Scope,
+		"policy":      result.Policy.Name,
+		"limit":       result.Policy.Requests,
+		"window":      result.Policy.Window.String(),
+		"burst":       result.Policy.Burst,
+		"retry_after": retryAfter,
+	})
+}
+
+// ceilSeconds rounds d up to whole seconds
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
+
+// bucketStore.shard returns the shard holding client's bucket (FNV-1a)
+func (s *bucketStore) shard(client string) *bucketShard {
+	h := uint32(2166136261)
+	for i := 0; i < len(client); i++ {
+		h ^= uint32(client[i])
+		h *= 16777619
+	}
+	return &s.shards[h%rateLimitShards]
+}
+
+// bucketStore.Take admits a request from client under policy p, starting
+// fresh state if the client is new or p's algorithm changed. maxClients
+// bounds the clients tracked across all shards.
+func (s *bucketStore) Take(client string, p *RateLimitPolicy, maxClients int, now time.Time) RateLimitResult {
+	sh := s.shard(client)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	e, ok := sh.buckets[client]
+	if ok {
+		sh.lru.MoveToFront(e)
+	} else {
+		if sh.buckets == nil {
+			sh.buckets = make(map[string]*list.Element)
+		}
+		sh.evict(now, max(1, maxClients/rateLimitShards))
+		e = sh.lru.PushFront(&bucketEntry{client: client})
+		sh.buckets[client] = e
+	}
+
+	entry := e.Value.(*bucketEntry)
+	if entry.algorithm != p.Algorithm {
+		entry.algorithm = p.Algorithm
+		entry.limiter = newLimiter(p, now)
+	}
+	return entry.limiter.Take(p, now)
+}
+
+// bucketStore.Len returns the number of clients being tracked
+func (s *bucketStore) Len() int {
+	n := 0
+	for i := range s.shards {
+		sh := &s.shards[i]
+		sh.mu.Lock()
+		n += sh.lru.Len()
+		sh.mu.Unlock()
+	}
+	return n
+}
+
+// bucketShard.evict makes room for a new client. Every sweep interval it
+// drops idle clients, then it evicts the least recently used clients while
+// the shard is at its limit.
+func (sh *bucketShard) evict(now time.Time, limit int) {
+	if now.Sub(sh.lastSweep) >= rateLimitSweepInterval {
+		sh.lastSweep = now
+		for e := sh.lru.Back(); e != nil; {
+			prev := e.Prev()
+			if entry := e.Value.(*bucketEntry); entry.limiter.Idle(now) {
+				sh.remove(e)
+			}
+			e = prev
+		}
+	}
+
+	for sh.lru.Len() >= limit {
+		sh.remove(sh.lru.Back())
+	}
+}
+
+func (sh *bucketShard) remove(e *list.Element) {
+	sh.lru.Remove(e)
+	delete(sh.buckets, e.Value.(*bucketEntry).client)
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// policyIDsByOwner maps each route's path prefix and each API key to its
+// policies' ids
+func policyIDsByOwner(t *testing.T, yaml string) map[string][]string {
+	t.Helper()
+	config, err := ParseConfig("test.yaml", []byte(yaml))
+	if err != nil {
+		t.Fatal(err)
+	}
+	router, err := NewRouter(config, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ids := make(map[string][]string)
+	for _, route := range router.routes {
+		for _, p := range route.RateLimits {
+			ids[route.PathPrefix] = append(ids[route.PathPrefix], p.id)
+		}
+	}
+	for key, policies := range config.KeyRateLimits {
+		for _, p := range policies {
+			ids[key] = append(ids[key], p.id)
+		}
+	}
+	return ids
+}
+
+// TestPolicyIDsStable checks that reordering routes and API keys keeps each
+// policy's id, so clients keep their buckets across the reload
+func TestPolicyIDsStable(t *testing.T) {
+	before := policyIDsByOwner(t, `
+backends: [http://localhost:8081]
+routes:
+  - path_prefix: /a
+    pool: default
+    rate_limits:
+      - requests: 10
+      - requests: 10
+        methods: [POST]
+  - path_prefix: /b
+    pool: default
+    rate_limits:
+      - requests: 10
+api_keys:
+  - key: key-one
+    rate_limits:
+      - requests: 5
+  - key: key-two
+    rate_limits:
+      - requests: 5
+`)
+	after := policyIDsByOwner(t, `
+backends: [http://localhost:8081]
+routes:
+  - path_prefix: /b
+    pool: default
+    rate_limits:
+      - requests: 10
+  - path_prefix: /a
+    pool: default
+    rate_limits:
+      - requests: 10
+      - requests: 10
+        methods: [POST]
+api_keys:
+  - key: key-two
+    rate_limits:
+      - requests: 5
+  - key: key-one
+    rate_limits:
+      - requests: 5
+`)
+
+	for owner, ids := range before {
+		if strings.Join(after[owner], ",") != strings.Join(ids, ",") {
+			t.Errorf("%s: ids %v became %v after reordering", owner, ids, after[owner])
+		}
+	}
+
+	// Every policy has its own buckets, and API keys stay out of the ids
+	seen := make(map[string]string)
+	for owner, ids := range before {
+		for _, id := range ids {
+			if other, ok := seen[id]; ok {
+				t.Errorf("%s and %s share id %s", owner, other, id)
+			}
+			seen[id] = owner
+			if strings.Contains(id, "key-") {
+				t.Errorf("API key appears in id %q", id)
+			}
+		}
+	}
+}
+
+// TestPolicyIDsDuplicates checks that identical policies on one route don't
+// share buckets
+func TestPolicyIDsDuplicates(t *testing.T) {
+	pcs := []RateLimitPolicyConfig{{Requests: 10}, {Requests: 10}}
+	ids := policyIDs("route", pcs)
+	if ids[0] == ids[1] {
+		t.Errorf("identical policies share id %s", ids[0])
+	}
+}
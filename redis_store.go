@@ -0,0 +1,261 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	defaultRedisPrefix  = "gateway:ratelimit:"
+	defaultRedisTimeout = 50 * time.Millisecond
+
+	// redisRetryInterval is how long rate limiting stays local after Redis
+	// fails before it is tried again
+	redisRetryInterval = time.Second
+)
+
+// The scripts below run each algorithm atomically in Redis, so replicas
+// share one limit per client. Times and durations are in microseconds and
+// now comes from the gateway, as with the local Limiters. They return the
+// state the Go side needs to describe the result.
+
+// tokenBucketScript takes a token from the bucket in KEYS[1].
+// ARGV: burst, refill rate per second, now.
+var tokenBucketScript = redis.NewScript(`
+local burst = tonumber(ARGV[1])
+local rate = tonumber(ARGV[2]) / 1e6
+local now = tonumber(ARGV[3])
+local state = redis.call('HMGET', KEYS[1], 'tokens', 'ts')
+local tokens = tonumber(state[1]) or burst
+local ts = tonumber(state[2]) or now
+if now > ts then
+  tokens = tokens + (now - ts) * rate
+  ts = now
+end
+tokens = math.min(tokens, burst)
+local allowed = 0
+if tokens >= 1 then
+  tokens = tokens - 1
+  allowed = 1
+end
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'ts', ts)
+redis.call('PEXPIRE', KEYS[1], math.ceil((burst - tokens) / rate / 1000) + 1000)
+return {allowed, tostring(tokens)}
+`)
+
+// gcraScript advances the TAT in KEYS[1].
+// ARGV: emission interval, tolerance, now.
+var gcraScript = redis.NewScript(`
+local interval = tonumber(ARGV[1])
+local tolerance = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+local tat = tonumber(redis.call('GET', KEYS[1])) or now
+if tat < now then
+  tat = now
+end
+local nxt = tat + interval
+if nxt - tolerance > now then
+  return {0, tostring(tat)}
+end
+redis.call('SET', KEYS[1], tostring(nxt), 'PX', math.ceil((nxt - now) / 1000) + 1)
+return {1, tostring(nxt)}
+`)
+
+// slidingWindowScript counts a request in the windows in KEYS[1].
+// ARGV: window, limit, now.
+var slidingWindowScript = redis.NewScript(`
+local window = tonumber(ARGV[1])
+local limit = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+local state = redis.call('HMGET', KEYS[1], 'start', 'prev', 'curr', 'window')
+local start = tonumber(state[1])
+local prev = tonumber(state[2]) or 0
+local curr = tonumber(state[3]) or 0
+if start == nil or tonumber(state[4]) ~= window then
+  start, prev, curr = now, 0, 0
+end
+if now < start then
+  now = start
+end
+local n = math.floor((now - start) / window)
+if n == 1 then
+  prev, curr, start = curr, 0, start + window
+elseif n > 1 then
+  prev, curr, start = 0, 0, start + n * window
+end
+local allowed = 0
+if prev * (1 - (now - start) / window) + curr + 1 <= limit then
+  curr = curr + 1
+  allowed = 1
+end
+redis.call('HSET', KEYS[1], 'start', tostring(start), 'prev', prev, 'curr', curr, 'window', window)
+redis.call('PEXPIRE', KEYS[1], math.ceil(2 * window / 1000))
+return {allowed, tostring(start), prev, curr}
+`)
+
+// slidingLogScript logs a request in the sorted set in KEYS[1].
+// ARGV: window, limit, now, a unique member for the request.
+var slidingLogScript = redis.NewScript(`
+local window = tonumber(ARGV[1])
+local limit = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', now - window)
+local n = redis.call('ZCARD', KEYS[1])
+local allowed = 0
+if n < limit then
+  redis.call('ZADD', KEYS[1], now, ARGV[4])
+  n = n + 1
+  allowed = 1
+end
+redis.call('PEXPIRE', KEYS[1], math.ceil(window / 1000))
+local i = math.max(0, n - limit)
+local oldest = redis.call('ZRANGE', KEYS[1], i, i, 'WITHSCORES')
+local newest = redis.call('ZRANGE', KEYS[1], -1, -1, 'WITHSCORES')
+return {allowed, n, oldest[2] or '0', newest[2] or '0'}
+`)
+
+// redisStore keeps rate limit state in Redis so gateway replicas share it.
+// After a failed call it reports itself unavailable for redisRetryInterval,
+// and the RateLimiter counts locally meanwhile.
+type redisStore struct {
+	config RedisConfig
+	client *redis.Client
+	seq    atomic.Uint64
+
+	// retryAt is when to try Redis again after a failure, in Unix nanos
+	retryAt atomic.Int64
+	down    atomic.Bool
+}
+
+// newRedisStore connects to the Redis server in rc. Connections are made
+// lazily, so an unreachable server only shows up as failed calls.
+func newRedisStore(rc RedisConfig) *redisStore {
+	return &redisStore{
+		config: rc,
+		client: redis.NewClient(&redis.Options{
+			Addr:         rc.Address,
+			Password:     rc.Password,
+			DB:           rc.DB,
+			DialTimeout:  rc.Timeout,
+			ReadTimeout:  rc.Timeout,
+			WriteTimeout: rc.Timeout,
+			MaxRetries:   -1,
+		}),
+	}
+}
+
+// redisStore.Available reports whether Redis should be used at now
+func (s *redisStore) Available(now time.Time) bool {
+	return !s.down.Load() || now.UnixNano() >= s.retryAt.Load()
+}
+
+// redisStore.Take admits a request from client under policy p
+func (s *redisStore) Take(ctx context.Context, client string, p *RateLimitPolicy, now time.Time) (RateLimitResult, error) {
+	key := s.config.Prefix + client
+	micros := now.UnixMicro()
+	var result RateLimitResult
+	var err error
+
+	switch p.Algorithm {
+	case algorithmGCRA:
+		interval, tolerance := gcraParams(p)
+		var vals []interface{}
+		vals, err = gcraScript.Run(ctx, s.client, []string{key},
+			interval.Microseconds(), tolerance.Microseconds(), micros).Slice()
+		if err == nil {
+			g := gcra{tat: time.UnixMicro(int64(parseFloat(vals[1])))}
+			result = g.result(p, toInt(vals[0]) == 1, now)
+		}
+
+	case algorithmSlidingWindow:
+		var vals []interface{}
+		vals, err = slidingWindowScript.Run(ctx, s.client, []string{key},
+			p.Window.Microseconds(), p.Requests, micros).Slice()
+		if err == nil {
+			sw := slidingWindow{
+				start:  time.UnixMicro(int64(parseFloat(vals[1]))),
+				window: p.Window,
+				prev:   toInt(vals[2]),
+				curr:   toInt(vals[3]),
+			}
+			if now.Before(sw.start) {
+				now = sw.start
+			}
+			result = sw.result(p, toInt(vals[0]) == 1, now)
+		}
+
+	case algorithmSlidingLog:
+		var vals []interface{}
+		member := fmt.Sprintf("%d-%d", micros, s.seq.Add(1))
+		vals, err = slidingLogScript.Run(ctx, s.client, []string{key},
+			p.Window.Microseconds(), p.Requests, micros, member).Slice()
+		if err == nil {
+			oldest := time.UnixMicro(int64(parseFloat(vals[2])))
+			newest := time.UnixMicro(int64(parseFloat(vals[3])))
+			result = logResult(p, toInt(vals[0]) == 1, toInt(vals[1]), oldest, newest, now)
+		}
+
+	default:
+		var vals []interface{}
+		rate := strconv.FormatFloat(p.rate(), 'f', -1, 64)
+		vals, err = tokenBucketScript.Run(ctx, s.client, []string{key},
+			p.Burst, rate, micros).Slice()
+		if err == nil {
+			tb := TokenBucket{
+				tokens:     parseFloat(vals[1]),
+				capacity:   float64(p.Burst),
+				refillRate: p.rate(),
+			}
+			result = tb.result(p, toInt(vals[0]) == 1)
+		}
+	}
+
+	if err != nil {
+		return result, err
+	}
+	if s.down.CompareAndSwap(true, false) {
+		log.Printf("Redis rate limit store at %s is reachable again", s.config.Address)
+	}
+	return result, nil
+}
+
+// redisStore.Failed takes Redis out of use for redisRetryInterval
+func (s *redisStore) Failed(now time.Time, err error) {
+	s.retryAt.Store(now.Add(redisRetryInterval).UnixNano())
+	if !s.down.Swap(true) {
+		log.Printf("Redis rate limit store at %s failed, counting locally: %v", s.config.Address, err)
+	}
+}
+
+// redisStore.Close closes the connections to Redis
+func (s *redisStore) Close() error {
+	return s.client.Close()
+}
+
+// redisClientKey stands in for an API key in Redis key names, so keys are
+// not readable by whoever can list them
+func redisClientKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:8])
+}
+
+// parseFloat reads a number returned by a script as a string
+func parseFloat(v interface{}) float64 {
+	s, _ := v.(string)
+	f, _ := strconv.ParseFloat(s, 64)
+	return f
+}
+
+// toInt reads an integer returned by a script
+func toInt(v interface{}) int {
+	n, _ := v.(int64)
+	return int(n)
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+// testRedis returns the config of a Redis server for a test: the server at
+// $GATEWAY_TEST_REDIS if set, or else an in-process stand-in. Each test
+// gets its own key prefix, and its keys are deleted afterwards.
+func testRedis(t *testing.T) *RedisConfig {
+	t.Helper()
+	rc := &RedisConfig{
+		Address: os.Getenv("GATEWAY_TEST_REDIS"),
+		Prefix:  fmt.Sprintf("gateway-test:%s:%d:", t.Name(), time.Now().UnixNano()),
+		Timeout: time.Second,
+	}
+	if rc.Address == "" {
+		rc.Address = miniredis.RunT(t).Addr()
+	}
+
+	t.Cleanup(func() {
+		client := redis.NewClient(&redis.Options{Addr: rc.Address})
+		defer client.Close()
+		ctx := context.Background()
+		if keys, err := client.Keys(ctx, rc.Prefix+"*").Result(); err == nil && len(keys) > 0 {
+			client.Del(ctx, keys...)
+		}
+	})
+	return rc
+}
+
+// redisKeys lists the keys under rc's prefix
+func redisKeys(t *testing.T, rc *RedisConfig) []string {
+	t.Helper()
+	client := redis.NewClient(&redis.Options{Addr: rc.Address})
+	defer client.Close()
+	keys, err := client.Keys(context.Background(), rc.Prefix+"*").Result()
+	if err != nil {
+		t.Fatalf("listing keys: %v", err)
+	}
+	return keys
+}
+
+// closeTo reports whether two durations agree to within a millisecond,
+// which covers Redis keeping times in microseconds and numbers as strings
+func closeTo(a, b time.Duration) bool {
+	d := a - b
+	return d > -time.Millisecond && d < time.Millisecond
+}
+
+// TestRedisStoreMatchesLocal drives each algorithm's script and the local
+// limiter with the same stepped clock and checks they agree on every request
+func TestRedisStoreMatchesLocal(t *testing.T) {
+	for _, algorithm := range algorithms {
+		t.Run(algorithm, func(t *testing.T) {
+			rc := testRedis(t)
+			store := newRedisStore(*rc)
+			defer store.Close()
+
+			p := testPolicy(algorithm)
+			local := newLimiter(p, epoch)
+
+			// A burst at one instant, then a request every 250ms
+			var times []time.Time
+			for i := 0; i < 12; i++ {
+				times = append(times, epoch)
+			}
+			for now := epoch; now.Before(epoch.Add(25 * time.Second)); now = now.Add(250 * time.Millisecond) {
+				times = append(times, now)
+			}
+
+			admitted := 0
+			for i, now := range times {
+				want := local.Take(p, now)
+				got, err := store.Take(context.Background(), "ip:test:1.2.3.4", p, now)
+				if err != nil {
+					t.Fatalf("request %d: %v", i, err)
+				}
+				if got.Allowed {
+					admitted++
+				}
+				if got.Allowed != want.Allowed || got.Limit != want.Limit || got.Remaining != want.Remaining ||
+					!closeTo(got.Reset, want.Reset) || !closeTo(got.RetryAfter, want.RetryAfter) {
+					t.Fatalf("request %d at %v: Redis %+v, local %+v", i, now.Sub(epoch), got, want)
+				}
+			}
+			if admitted == 0 || admitted == len(times) {
+				t.Errorf("admitted %d of %d requests; the sequence should exercise both", admitted, len(times))
+			}
+		})
+	}
+}
+
+// TestRedisSharedLimit checks that two gateways pointed at one Redis server
+// enforce a single limit between them
+func TestRedisSharedLimit(t *testing.T) {
+	for _, algorithm := range algorithms {
+		t.Run(algorithm, func(t *testing.T) {
+			rc := testRedis(t)
+			config := DefaultConfig()
+			config.RateLimitPerIP = 4
+			config.RateLimitPerKey = 3
+			config.RateLimitAlgorithm = algorithm
+			config.RateLimitRedis = rc
+
+			gateways := []*RateLimiter{{}, {}}
+			for _, rl := range gateways {
+				rl.Configure(config)
+				defer rl.Configure(DefaultConfig())
+			}
+
+			r := httptest.NewRequest("GET", "/api/users", nil)
+			count := func(ip, key string) int {
+				admitted := 0
+				for i := 0; i < 10; i++ {
+					if gateways[i%2].Allow(r, ip, key, nil, config).Allowed {
+						admitted++
+					}
+				}
+				return admitted
+			}
+
+			if n := count("10.0.0.1", ""); n != 4 {
+				t.Errorf("admitted %d requests by IP across both gateways, want 4", n)
+			}
+			config.RateLimitPerIP = 1000
+			if n := count("10.0.0.2", "key-secret"); n != 3 {
+				t.Errorf("admitted %d requests by API key across both gateways, want 3", n)
+			}
+
+			// Both gateways counted in Redis, not locally
+			for _, rl := range gateways {
+				if n := rl.ips.Len() + rl.keys.Len(); n != 0 {
+					t.Errorf("%d clients counted locally", n)
+				}
+			}
+
+			keys := redisKeys(t, rc)
+			if len(keys) != 3 {
+				t.Errorf("keys = %v, want one per client IP and one for the API key", keys)
+			}
+			for _, key := range keys {
+				if strings.Contains(key, "key-secret") {
+					t.Errorf("API key appears in Redis key %q", key)
+				}
+			}
+		})
+	}
+}
+
+// TestRedisFallback stops Redis and checks that requests are counted locally
+// until it is back
+func TestRedisFallback(t *testing.T) {
+	mr := miniredis.RunT(t)
+	config := DefaultConfig()
+	config.RateLimitPerIP = 2
+	config.RateLimitRedis = &RedisConfig{
+		Address: mr.Addr(),
+		Prefix:  defaultRedisPrefix,
+		Timeout: 100 * time.Millisecond,
+	}
+	rl := &RateLimiter{}
+	rl.Configure(config)
+	defer rl.Configure(DefaultConfig())
+
+	r := httptest.NewRequest("GET", "/api/users", nil)
+	if !rl.Allow(r, "10.0.0.1", "", nil, config).Allowed {
+		t.Fatal("first request rejected")
+	}
+	mr.Close()
+
+	// The local limiter takes over with a fresh count
+	for i := 0; i < 2; i++ {
+		if !rl.Allow(r, "10.0.0.1", "", nil, config).Allowed {
+			t.Fatalf("request %d rejected during outage", i+1)
+		}
+	}
+	if rl.Allow(r, "10.0.0.1", "", nil, config).Allowed {
+		t.Error("local limit not enforced during outage")
+	}
+	if rl.ips.Len() != 1 {
+		t.Errorf("%d clients counted locally, want 1", rl.ips.Len())
+	}
+	if status := rl.Status(); status["available"] != false {
+		t.Errorf("status = %v, want unavailable", status)
+	}
+
+	// Once the retry interval has passed Redis is used again, where the
+	// client has only spent one request
+	if err := mr.Restart(); err != nil {
+		t.Fatal(err)
+	}
+	rl.remote.Load().retryAt.Store(0)
+	if !rl.Allow(r, "10.0.0.1", "", nil, config).Allowed {
+		t.Error("request rejected after Redis came back")
+	}
+	if rl.Allow(r, "10.0.0.1", "", nil, config).Allowed {
+		t.Error("request allowed over the limit kept in Redis")
+	}
+	if status := rl.Status(); status["available"] != true {
+		t.Errorf("status = %v, want available", status)
+	}
+}
+
+// TestRedisFallbackMidRequest points the limiter at a server that accepts
+// connections but never replies, and checks that the request whose call
+// times out is answered from the local store
+func TestRedisFallbackMidRequest(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mu sync.Mutex
+	var conns []net.Conn
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			conns = append(conns, conn)
+			mu.Unlock()
+		}
+	}()
+	t.Cleanup(func() {
+		ln.Close()
+		mu.Lock()
+		defer mu.Unlock()
+		for _, conn := range conns {
+			conn.Close()
+		}
+	})
+
+	config := DefaultConfig()
+	config.RateLimitPerIP = 1
+	config.RateLimitRedis = &RedisConfig{
+		Address: ln.Addr().String(),
+		Prefix:  defaultRedisPrefix,
+		Timeout: 50 * time.Millisecond,
+	}
+	rl := &RateLimiter{}
+	rl.Configure(config)
+	defer rl.Configure(DefaultConfig())
+
+	r := httptest.NewRequest("GET", "/api/users", nil)
+	start := time.Now()
+	if !rl.Allow(r, "10.0.0.1", "", nil, config).Allowed {
+		t.Fatal("request rejected when Redis stopped replying")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("request took %v, want about the 50ms timeout", elapsed)
+	}
+	if rl.ips.Len() != 1 {
+		t.Errorf("%d clients counted locally, want 1", rl.ips.Len())
+	}
+	if status := rl.Status(); status["available"] != false {
+		t.Errorf("status = %v, want unavailable", status)
+	}
+
+	// Until the retry interval passes requests don't wait on Redis at all
+	start = time.Now()
+	if rl.Allow(r, "10.0.0.1", "", nil, config).Allowed {
+		t.Error("local limit not enforced after the timeout")
+	}
+	if elapsed := time.Since(start); elapsed >= 50*time.Millisecond {
+		t.Errorf("request during outage took %v, waiting on Redis", elapsed)
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// configPollInterval is how often the config file is checked for changes
+const configPollInterval = 2 * time.Second
+
+// Reload applies a new configuration to the running gateway. Backends that
+// remain configured keep their health state, rate limit buckets keep their
+// tokens, and in-flight requests finish on the backend they started on. On
+// error the current configuration stays active.
+func (g *Gateway) Reload(config *Config) error {
+	old := g.currentConfig()
+	if config.ListenAddr != old.ListenAddr {
+		log.Printf("Listen address change to %s requires a restart, still serving on %s", config.ListenAddr, old.ListenAddr)
+		config.ListenAddr = old.ListenAddr
+	}
+
+	router, err := NewRouter(config, g.currentRouter())
+	if err != nil {
+		return err
+	}
+	if config.LogFile != old.LogFile {
+		if err := g.logger.Reopen(config.LogFile); err != nil {
+			log.Printf("Cannot switch log file to %s, still logging to %s: %v", config.LogFile, old.LogFile, err)
+			config.LogFile = old.LogFile
+		}
+	}
+
+	g.retryBudget.Configure(config.RetryBudgetRatio, config.RetryBudgetMinPerSecond)
+	g.shedder.Configure(config.LoadShedding)
+	g.rateLimiter.Configure(config)
+
+	g.mu.Lock()
+	g.config = config
+	g.router = router
+	g.mu.Unlock()
+
+	return nil
+}
+
+// WatchConfig reloads the config on SIGHUP or when the file at path changes.
+// load builds the new Config, including command-line overrides.
+func (g *Gateway) WatchConfig(path string, load func() (*Config, error)) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	ticker := time.NewTicker(configPollInterval)
+	defer ticker.Stop()
+
+	lastMod := configModTime(path)
+
+	for {
+		var reason string
+		select {
+		case <-g.stop:
+			return
+		case <-hup:
+			reason = "SIGHUP"
+		case <-ticker.C:
+			mod := configModTime(path)
+			if mod.Equal(lastMod) {
+				continue
+			}
+			reason = "config file changed"
+		}
+		lastMod = configModTime(path)
+
+		config, err := load()
+		if err != nil {
+			log.Printf("Config reload (%s) failed, keeping current config: %v", reason, err)
+			continue
+		}
+		if err := g.Reload(config); err != nil {
+			log.Printf("Config reload (%s) failed, keeping current config: %v", reason, err)
+			continue
+		}
+		log.Printf("Config reloaded (%s)", reason)
+		for _, pool := range g.currentRouter().Pools() {
+			log.Printf("Pool %s routing to backends: %v", pool.Name, pool.LB.URLs())
+		}
+	}
+}
+
+// configModTime returns the file's modification time, or the zero time if it
+// cannot be read
+func configModTime(path string) time.Time {
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
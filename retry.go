@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Retry defaults, used for fields left unset
+const (
+	defaultRetryAttempts   = 3
+	defaultRetryBackoff    = 25 * time.Millisecond
+	defaultRetryMaxBackoff = 250 * time.Millisecond
+	defaultRetryMaxBody    = 64 << 10
+
+	defaultRetryBudgetRatio        = 0.2
+	defaultRetryBudgetMinPerSecond = 10
+
+	// retryBudgetWindow is how long requests and retries count toward the
+	// budget, in one-second buckets
+	retryBudgetWindow = 10
+)
+
+// defaultRetryMethods are the idempotent methods retried unless a route
+// lists its own
+var defaultRetryMethods = []string{
+	http.MethodGet, http.MethodHead, http.MethodOptions,
+	http.MethodPut, http.MethodDelete, http.MethodTrace,
+}
+
+// RetryPolicy retries a route's failed requests on another backend.
+// Connection failures are always retried; responses are retried when their
+// status is in Statuses.
+type RetryPolicy struct {
+	Attempts   int // total attempts, including the first
+	Statuses   map[int]bool
+	Methods    map[string]bool
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	MaxBody    int64
+}
+
+// newRetryPolicy builds a route's retry policy from its config. It returns
+// nil when the route has none configured.
+func newRetryPolicy(rc *RetryConfig) *RetryPolicy {
+	if rc == nil {
+		return nil
+	}
+
+	rp := &RetryPolicy{
+		Attempts:   rc.Attempts,
+		Statuses:   make(map[int]bool, len(rc.OnStatus)),
+		Methods:    make(map[string]bool),
+		Backoff:    rc.Backoff,
+		MaxBackoff: rc.MaxBackoff,
+		MaxBody:    rc.MaxBody,
+	}
+	if rp.Attempts == 0 {
+		rp.Attempts = defaultRetryAttempts
+	}
+	for _, status := range rc.OnStatus {
+		rp.Statuses[status] = true
+	}
+	methods := rc.Methods
+	if len(methods) == 0 {
+		methods = defaultRetryMethods
+	}
+	for _, method := range methods {
+		rp.Methods[method] = true
+	}
+	if rp.Backoff == 0 {
+		rp.Backoff = defaultRetryBackoff
+	}
+	if rp.MaxBackoff == 0 {
+		rp.MaxBackoff = defaultRetryMaxBackoff
+	}
+	if rp.MaxBody == 0 {
+		rp.MaxBody = defaultRetryMaxBody
+	}
+	return rp
+}
+
+// RetryPolicy.retryable reports whether an attempt that ended with status
+// or err should be retried
+func (rp *RetryPolicy) retryable(status int, err error) bool {
+	if err != nil {
+		return isConnectError(err) || isOverloaded(err) || rp.Statuses[http.StatusBadGateway]
+	}
+	return rp.Statuses[status]
+}
+
+// RetryPolicy.backoff returns the delay before the given retry (1 for the
+// first), doubling each time with full jitter
+func (rp *RetryPolicy) backoff(retry int) time.Duration {
+	d := rp.Backoff << (retry - 1)
+	if d > rp.MaxBackoff || d <= 0 {
+		d = rp.MaxBackoff
+	}
+	return time.Duration(rand.Int63n(int64(d) + 1))
+}
+
+// RetryPolicy.bufferBody reads r's body so it can be replayed. It returns
+// nil and false if the method isn't retried or the body is over MaxBody; the
+// body is then restored so the request can still be sent once.
+func (rp *RetryPolicy) bufferBody(r *http.Request) ([]byte, bool) {
+	if !rp.Methods[r.Method] {
+		return nil, false
+	}
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil, true
+	}
+	if r.ContentLength > rp.MaxBody {
+		return nil, false
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, rp.MaxBody+1))
+	if err != nil || int64(len(body)) > rp.MaxBody {
+		r.Body = readCloser{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+		return nil, false
+	}
+	r.Body.Close()
+	return body, true
+}
+
+// readCloser reads from a replacement reader but closes the original body
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// withBody returns a copy of r that sends body, or r itself if there is no
+// body to replay
+func withBody(r *http.Request, body []byte) *http.Request {
+	if body == nil {
+		return r
+	}
+	out := r.Clone(r.Context())
+	out.Body = io.NopCloser(bytes.NewReader(body))
+	out.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(body)), nil
+	}
+	out.ContentLength = int64(len(body))
+	return out
+}
+
+// isConnectError reports whether err means the backend was never reached,
+// so the request was not sent
+func isConnectError(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// RetryBudget caps retries across the gateway at Ratio of recent requests
+// plus MinPerSecond, so retries can't multiply load on a pool that is
+// already failing
+type RetryBudget struct {
+	Ratio        float64
+	MinPerSecond int
+
+	buckets [retryBudgetWindow]retryBucket
+	mu      sync.Mutex
+}
+
+// retryBucket counts requests and retries for one second
+type retryBucket struct {
+	second   int64
+	requests int
+	retries  int
+}
+
+// RetryBudget.Configure applies new budget settings, keeping the counts
+func (rb *RetryBudget) Configure(ratio float64, minPerSecond int) {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	rb.Ratio = ratio
+	rb.MinPerSecond = minPerSecond
+}
+
+// RetryBudget.Request counts a proxied request toward the budget
+func (rb *RetryBudget) Request() {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	rb.bucket(time.Now()).requests++
+}
+
+// RetryBudget.Withdraw spends one retry, reporting false if the budget is
+// exhausted
+func (rb *RetryBudget) Withdraw() bool {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+
+	now := time.Now()
+	second := now.Unix()
+	requests, retries := 0, 0
+	for _, b := range rb.buckets {
+		if second-b.second < retryBudgetWindow {
+			requests += b.requests
+			retries += b.retries
+		}
+	}
+
+	allowed := rb.Ratio*float64(requests) + float64(rb.MinPerSecond*retryBudgetWindow)
+	if float64(retries) >= allowed {
+		return false
+	}
+	rb.bucket(now).retries++
+	return true
+}
+
+// bucket returns the bucket for now, clearing it if it is stale. The caller
+// holds rb.mu.
+func (rb *RetryBudget) bucket(now time.Time) *retryBucket {
+	second := now.Unix()
+	b := &rb.buckets[second%retryBudgetWindow]
+	if b.second != second {
+		*b = retryBucket{second: second}
+	}
+	return b
+}
+
+// attemptWriter holds back the headers of a response until its status is
+// known. If hold approves a retry for that status the response is discarded
+// instead of being sent to the client.
+type attemptWriter struct {
+	http.ResponseWriter
+	header    http.Header
+	committed bool
+	held      bool
+	hold      func(status int) bool
+}
+
+func (w *attemptWriter) Header() http.Header {
+	if w.committed {
+		return w.ResponseWriter.Header()
+	}
+	return w.header
+}
+
+func (w *attemptWriter) WriteHeader(status int) {
+	if w.committed || w.held {
+		return
+	}
+	if status >= 100 && status < 200 {
+		return
+	}
+	if w.hold(status) {
+		w.held = true
+		return
+	}
+
+	dst := w.ResponseWriter.Header()
+	for name, values := range w.header {
+		dst[name] = values
+	}
+	w.committed = true
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *attemptWriter) Write(b []byte) (int, error) {
+	if !w.committed && !w.held {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.held {
+		return len(b), nil
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Flush flushes the response once it has been committed to the client
+func (w *attemptWriter) Flush() {
+	if w.committed {
+		http.NewResponseController(w.ResponseWriter).Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (w *attemptWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
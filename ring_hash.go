@@ -0,0 +1,183 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	// ringReplicas is the number of ring points per unit of backend weight
+	ringReplicas = 100
+
+	// defaultHashLoadFactor caps a backend at 125% of the average load
+	defaultHashLoadFactor = 1.25
+)
+
+// ringHash is consistent hashing with bounded loads. Each backend owns
+// points on a hash ring and a request goes to the first backend clockwise
+// from the hash of its key, so when a backend leaves only the keys it owned
+// move. Backends already carrying more than loadFactor times the average
+// in-flight load are skipped, which keeps hot keys from overloading a single
+// backend.
+type ringHash struct {
+	key        hashKey
+	loadFactor float64
+
+	// points is built from the pool's whole backend set, so excluding a
+	// backend for one request moves only the keys it owned
+	points []ringPoint
+}
+
+type ringPoint struct {
+	hash    uint64
+	backend *Backend
+}
+
+// hashKey extracts the value requests are hashed on
+type hashKey struct {
+	source string // header, cookie, query or ip
+	name   string
+}
+
+// newRingHash creates a ring hash strategy keyed by spec, which is one of
+// "header:<name>", "cookie:<name>", "query:<name>" or "ip"
+func newRingHash(spec string, loadFactor float64) (*ringHash, error) {
+	key, err := parseHashKey(spec)
+	if err != nil {
+		return nil, err
+	}
+	if loadFactor == 0 {
+		loadFactor = defaultHashLoadFactor
+	}
+	if loadFactor < 1 {
+		return nil, fmt.Errorf("hash load factor must be at least 1, got %g", loadFactor)
+	}
+	return &ringHash{key: key, loadFactor: loadFactor}, nil
+}
+
+func parseHashKey(spec string) (hashKey, error) {
+	if spec == "ip" {
+		return hashKey{source: "ip"}, nil
+	}
+
+	source, name, ok := strings.Cut(spec, ":")
+	if ok && name != "" {
+		switch source {
+		case "header", "cookie", "query":
+			return hashKey{source: source, name: name}, nil
+		}
+	}
+	return hashKey{}, fmt.Errorf(`invalid hash key %q (want "header:<name>", "cookie:<name>", "query:<name>" or "ip")`, spec)
+}
+
+// hashKey.value returns the key for r. Requests without the configured
+// header, cookie or query parameter are hashed by client IP.
+func (k hashKey) value(r *http.Request) string {
+	var v string
+	switch k.source {
+	case "header":
+		v = r.Header.Get(k.name)
+	case "cookie":
+		if c, err := r.Cookie(k.name); err == nil {
+			v = c.Value
+		}
+	case "query":
+		v = r.URL.Query().Get(k.name)
+	}
+	if v == "" {
+		v = remoteIP(r)
+	}
+	return v
+}
+
+func (rh *ringHash) Name() string { return strategyRingHash }
+
+func (rh *ringHash) Pick(candidates []*Backend, r *http.Request) *Backend {
+	if len(candidates) == 0 {
+		return nil
+	}
+	available := make(map[*Backend]bool, len(candidates))
+	for _, b := range candidates {
+		available[b] = true
+	}
+
+	// Bounded loads: no backend takes more than loadFactor times its
+	// weighted share of the in-flight requests (counting this one)
+	var inFlight int64
+	totalWeight := 0
+	for _, b := range candidates {
+		inFlight += b.InFlight()
+		totalWeight += b.Weight
+	}
+	capacity := func(b *Backend) float64 {
+		share := float64(inFlight+1) * float64(b.Weight) / float64(totalWeight)
+		return math.Ceil(rh.loadFactor * share)
+	}
+
+	h := hash64(rh.key.value(r))
+	start := sort.Search(len(rh.points), func(i int) bool {
+		return rh.points[i].hash >= h
+	})
+
+	// Walk clockwise past backends that can't take this request
+	var owner *Backend
+	tried := make(map[*Backend]bool, len(candidates))
+	for i := 0; i < len(rh.points) && len(tried) < len(candidates); i++ {
+		b := rh.points[(start+i)%len(rh.points)].backend
+		if !available[b] || tried[b] {
+			continue
+		}
+		tried[b] = true
+		if owner == nil {
+			owner = b
+		}
+		if float64(b.InFlight()+1) <= capacity(b) {
+			return b
+		}
+	}
+
+	// Everyone is at capacity; stay with the key's owner
+	if owner == nil {
+		return candidates[0]
+	}
+	return owner
+}
+
+// build places the pool's backends on the ring by weight. It is called
+// when the backend set or weights change, not per request.
+func (rh *ringHash) build(backends []*Backend) {
+	points := make([]ringPoint, 0, len(backends)*ringReplicas)
+	for _, b := range backends {
+		for i := 0; i < b.Weight*ringReplicas; i++ {
+			points = append(points, ringPoint{
+				hash:    hash64(b.URL.String() + "#" + strconv.Itoa(i)),
+				backend: b,
+			})
+		}
+	}
+	sort.Slice(points, func(i, j int) bool {
+		return points[i].hash < points[j].hash
+	})
+
+	rh.points = points
+}
+
+// hash64 is FNV-1a with a final avalanche step, since FNV alone clusters
+// similar keys such as consecutive IDs
+func hash64(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	x := h.Sum64()
+
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"testing"
+)
+
+// TestRingHashExclusion checks that excluding a backend moves only the keys
+// it owned and leaves the ring as built
+func TestRingHashExclusion(t *testing.T) {
+	router := testRouter(t, `
+pools:
+  default:
+    strategy: ring_hash
+    hash_key: header:X-User
+    backends:
+      - http://localhost:8081
+      - http://localhost:8082
+      - http://localhost:8083
+`)
+	lb := router.pools[defaultPool].LB
+	rh := lb.strategy.(*ringHash)
+	points := &rh.points[0]
+
+	owners := make(map[string]*Backend)
+	for i := 0; i < 300; i++ {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("X-User", fmt.Sprint(i))
+		owners[fmt.Sprint(i)] = lb.Next(r)
+	}
+
+	excluded := lb.backends[0]
+	moved := 0
+	for user, owner := range owners {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("X-User", user)
+		b := lb.NextExcept(r, map[*Backend]bool{excluded: true})
+		switch {
+		case b == excluded:
+			t.Fatalf("user %s sent to excluded backend", user)
+		case owner != excluded && b != owner:
+			t.Errorf("user %s moved from %s to %s", user, owner.URL, b.URL)
+		case owner == excluded:
+			moved++
+		}
+	}
+	if moved == 0 {
+		t.Error("excluded backend owned no keys")
+	}
+	if &rh.points[0] != points {
+		t.Error("ring rebuilt for an excluded backend")
+	}
+}
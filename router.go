@@ -0,0 +1,421 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// defaultNotFoundBody is returned for requests that match no route
+var defaultNotFoundBody = []byte(`{"error":"no route matches request"}`)
+
+// Pool is a named group of backends behind its own load balancer. A reload
+// creates a new Pool with the new settings around the existing LoadBalancer.
+type Pool struct {
+	Name    string
+	LB      *LoadBalancer
+	Sticky  *StickySessions
+	Health  *HealthCheck
+	Outlier *OutlierDetection
+}
+
+// Route sends requests matching all of its conditions to a pool. Empty
+// conditions match everything.
+type Route struct {
+	Host       string // exact host, or "*.example.com" for any subdomain
+	Path       string
+	PathPrefix string
+	PathRegex  *regexp.Regexp
+	Methods    []string
+	Headers    map[string]string
+	Pool       *Pool
+	Rewrite    *Rewrite
+	Retry      *RetryPolicy
+	Hedge      *HedgePolicy
+	Timeouts   Timeouts
+	Priority   int       // queue priority of the route's requests
+	Queue      *Bulkhead // nil when the route has no concurrency limit
+	RateLimits []*RateLimitPolicy
+}
+
+// Rewrite changes a request's path and query before it is proxied
+type Rewrite struct {
+	StripPrefix string
+	Regex       *regexp.Regexp
+	Replacement string
+	AddPrefix   string
+	Query       map[string]string
+}
+
+// Router holds the routes and pools built from one configuration
+type Router struct {
+	routes   []*Route
+	pools    map[string]*Pool
+	notFound []byte
+}
+
+// NewRouter builds a router from config. Pools that already exist in old keep
+// their LoadBalancer, so unchanged backends keep their health state.
+func NewRouter(config *Config, old *Router) (*Router, error) {
+	// Parse everything up front so a bad config leaves old untouched
+	poolConfigs := config.poolConfigs()
+	poolBackends := make(map[string][]*Backend)
+	poolStrategies := make(map[string]Strategy)
+	poolHealth := make(map[string]*HealthCheck)
+	for name, pc := range poolConfigs {
+		backends := make([]*Backend, 0, len(pc.Backends))
+		for _, bc := range pc.Backends {
+			backend, err := newBackend(bc.URL, bc.Weight)
+			if err != nil {
+				return nil, err
+			}
+			backends = append(backends, backend)
+		}
+		poolBackends[name] = backends
+
+		strategy, err := newStrategy(pc)
+		if err != nil {
+			return nil, fmt.Errorf("pool %s: %v", name, err)
+		}
+		poolStrategies[name] = strategy
+
+		health, err := newHealthCheck(pc.HealthCheck, config.HealthCheckInterval)
+		if err != nil {
+			return nil, fmt.Errorf("pool %s: %v", name, err)
+		}
+		poolHealth[name] = health
+	}
+
+	routes := make([]*Route, 0, len(config.Routes))
+	for _, rc := range config.Routes {
+		route := &Route{
+			Host:       strings.ToLower(rc.Host),
+			Path:       rc.Path,
+			PathPrefix: rc.PathPrefix,
+			Methods:    rc.Methods,
+			Headers:    make(map[string]string, len(rc.Headers)),
+			Retry:      newRetryPolicy(rc.Retry),
+			Hedge:      newHedgePolicy(rc.Hedge),
+			Timeouts:   newTimeouts(config.Timeouts, rc.Timeouts),
+			Priority:   rc.Priority,
+			Queue:      newBulkhead(rc.Concurrency),
+		}
+		for name, value := range rc.Headers {
+			route.Headers[http.CanonicalHeaderKey(name)] = value
+		}
+		if rc.PathRegex != "" {
+			re, err := regexp.Compile(rc.PathRegex)
+			if err != nil {
+				return nil, fmt.Errorf("invalid route regex %q: %v", rc.PathRegex, err)
+			}
+			route.PathRegex = re
+		}
+		if rw := rc.Rewrite; rw != nil {
+			route.Rewrite = &Rewrite{
+				StripPrefix: rw.StripPrefix,
+				Replacement: rw.Replacement,
+				AddPrefix:   rw.AddPrefix,
+				Query:       rw.Query,
+			}
+			if rw.Regex != "" {
+				re, err := regexp.Compile(rw.Regex)
+				if err != nil {
+					return nil, fmt.Errorf("invalid rewrite regex %q: %v", rw.Regex, err)
+				}
+				route.Rewrite.Regex = re
+			}
+		}
+		if route.Path == "" && route.PathPrefix == "" && route.PathRegex == nil {
+			route.PathPrefix = "/"
+		}
+		if _, ok := poolBackends[rc.Pool]; !ok {
+			return nil, fmt.Errorf("route references unknown pool %q", rc.Pool)
+		}
+		owner := fmt.Sprintf("route %q %q %q %q %q %v", rc.Host, rc.Path, rc.PathPrefix, rc.PathRegex, rc.Methods, rc.Headers)
+		for j, id := range policyIDs(owner, rc.RateLimits) {
+			route.RateLimits = append(route.RateLimits, newRateLimitPolicy(id, route.String(), rc.RateLimits[j]))
+		}
+		routes = append(routes, route)
+	}
+
+	rr := &Router{
+		routes:   routes,
+		pools:    make(map[string]*Pool),
+		notFound: config.NotFoundBody,
+	}
+	if rr.notFound == nil {
+		rr.notFound = defaultNotFoundBody
+	}
+
+	for name, backends := range poolBackends {
+		pool := &Pool{
+			Name:    name,
+			Health:  poolHealth[name],
+			Outlier: newOutlierDetection(poolConfigs[name].OutlierDetection),
+		}
+		if sc := poolConfigs[name].Sticky; sc != nil {
+			pool.Sticky = newStickySessions(name, sc)
+		}
+
+		if old != nil && old.pools[name] != nil {
+			pool.LB = old.pools[name].LB
+			pool.LB.SetBackends(backends)
+			pool.LB.SetStrategy(poolStrategies[name])
+			pool.LB.SetBreaker(newCircuitBreaker(poolConfigs[name].CircuitBreaker))
+			pool.LB.SetConcurrency(poolConfigs[name].Concurrency, poolConfigs[name].Adaptive)
+		} else {
+			pool.LB = &LoadBalancer{
+				backends: backends,
+				breaker:  newCircuitBreaker(poolConfigs[name].CircuitBreaker),
+			}
+			pool.LB.SetStrategy(poolStrategies[name])
+			pool.LB.SetConcurrency(poolConfigs[name].Concurrency, poolConfigs[name].Adaptive)
+		}
+		rr.pools[name] = pool
+	}
+
+	for i, rc := range config.Routes {
+		routes[i].Pool = rr.pools[rc.Pool]
+	}
+
+	// Without routes everything goes to the default pool
+	if len(routes) == 0 {
+		if rr.pools[defaultPool] == nil {
+			return nil, fmt.Errorf("no routes defined and no %q pool", defaultPool)
+		}
+		rr.routes = []*Route{{
+			PathPrefix: "/",
+			Pool:       rr.pools[defaultPool],
+			Timeouts:   newTimeouts(config.Timeouts, nil),
+		}}
+	}
+
+	sort.SliceStable(rr.routes, func(i, j int) bool {
+		return rr.routes[i].before(rr.routes[j])
+	})
+
+	return rr, nil
+}
+
+// Pool.Observe feeds the outcome of a request to the pool's outlier
+// detection and circuit breaker. Requests turned away by the backend's
+// concurrency limits never reached it and are not counted, though any
+// half-open trial they took is given back.
+func (p *Pool) Observe(backend *Backend, result ProxyResult) {
+	if isOverloaded(result.Err) {
+		if cb := p.LB.Breaker(); cb != nil {
+			cb.Release(backend)
+		}
+		return
+	}
+	if p.Outlier != nil {
+		p.Outlier.Observe(p.LB, backend, result)
+	}
+	if cb := p.LB.Breaker(); cb != nil {
+		cb.Record(backend, result)
+	}
+}
+
+// poolConfigs returns the config of every pool, with the top-level backends
+// forming the default pool
+func (c *Config) poolConfigs() map[string]PoolConfig {
+	pools := make(map[string]PoolConfig, len(c.Pools)+1)
+	for name, pool := range c.Pools {
+		pools[name] = pool
+	}
+	if len(c.Backends) > 0 {
+		pool := pools[defaultPool]
+		pool.Backends = c.Backends
+		pools[defaultPool] = pool
+	}
+	return pools
+}
+
+// Match returns the first route matching r, or nil
+func (rr *Router) Match(r *http.Request) *Route {
+	for _, route := range rr.routes {
+		if route.Match(r) {
+			return route
+		}
+	}
+	return nil
+}
+
+// Pools returns the router's pools sorted by name
+func (rr *Router) Pools() []*Pool {
+	pools := make([]*Pool, 0, len(rr.pools))
+	for _, pool := range rr.pools {
+		pools = append(pools, pool)
+	}
+	sort.Slice(pools, func(i, j int) bool {
+		return pools[i].Name < pools[j].Name
+	})
+	return pools
+}
+
+// Route.String describes the route by its host and path conditions
+func (rt *Route) String() string {
+	s := rt.Host
+	switch {
+	case rt.Path != "":
+		s += rt.Path
+	case rt.PathRegex != nil:
+		s += "~" + rt.PathRegex.String()
+	default:
+		s += rt.PathPrefix + "*"
+	}
+	if len(rt.Methods) > 0 {
+		s = strings.Join(rt.Methods, ",") + " " + s
+	}
+	return s
+}
+
+// Route.Match reports whether r satisfies every condition of the route
+func (rt *Route) Match(r *http.Request) bool {
+	return rt.matchHost(r) && rt.matchPath(r) && rt.matchMethod(r) && rt.matchHeaders(r)
+}
+
+func (rt *Route) matchHost(r *http.Request) bool {
+	if rt.Host == "" {
+		return true
+	}
+
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(host)
+
+	if strings.HasPrefix(rt.Host, "*.") {
+		return strings.HasSuffix(host, rt.Host[1:])
+	}
+	return host == rt.Host
+}
+
+func (rt *Route) matchPath(r *http.Request) bool {
+	path := r.URL.Path
+	switch {
+	case rt.Path != "":
+		return path == rt.Path
+	case rt.PathPrefix != "":
+		return hasPathPrefix(path, rt.PathPrefix)
+	case rt.PathRegex != nil:
+		return rt.PathRegex.MatchString(path)
+	}
+	return false
+}
+
+// hasPathPrefix reports whether path is prefix or lies under it, comparing
+// whole segments: /users matches /users and /users/1 but not /usersfoo
+func hasPathPrefix(path, prefix string) bool {
+	if !strings.HasPrefix(path, prefix) {
+		return false
+	}
+	return len(path) == len(prefix) || strings.HasSuffix(prefix, "/") || path[len(prefix)] == '/'
+}
+
+func (rt *Route) matchMethod(r *http.Request) bool {
+	if len(rt.Methods) == 0 {
+		return true
+	}
+	for _, method := range rt.Methods {
+		if r.Method == method {
+			return true
+		}
+	}
+	return false
+}
+
+func (rt *Route) matchHeaders(r *http.Request) bool {
+	for name, value := range rt.Headers {
+		if r.Header.Get(name) != value {
+			return false
+		}
+	}
+	return true
+}
+
+// Rewrite.Apply returns a copy of r with the rewritten path and query. The
+// regex replacement may refer to capture groups as $1, $2 or ${name}.
+func (rw *Rewrite) Apply(r *http.Request) *http.Request {
+	out := r.Clone(r.Context())
+	path := r.URL.Path
+
+	if rw.StripPrefix != "" && hasPathPrefix(path, rw.StripPrefix) {
+		path = path[len(rw.StripPrefix):]
+	}
+	if rw.Regex != nil {
+		path = rw.Regex.ReplaceAllString(path, rw.Replacement)
+	}
+	if rw.AddPrefix != "" {
+		path = strings.TrimSuffix(rw.AddPrefix, "/") + "/" + strings.TrimPrefix(path, "/")
+	}
+	// Stripping can leave an empty or relative path
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	out.URL.Path = path
+	out.URL.RawPath = ""
+
+	if len(rw.Query) > 0 {
+		query := out.URL.Query()
+		for name, value := range rw.Query {
+			query.Set(name, value)
+		}
+		out.URL.RawQuery = query.Encode()
+	}
+
+	return out
+}
+
+// Route.before defines route priority. Routes are compared by, in order:
+//  1. host: exact hosts, then wildcards (longest suffix first), then any host
+//  2. path: exact paths, then regexes, then prefixes (longest first); a route
+//     without a path condition counts as the prefix "/"
+//  3. number of header conditions, most first
+//  4. routes limited to specific methods before those accepting any method
+//
+// Routes that tie on all of these keep their config order.
+func (rt *Route) before(other *Route) bool {
+	if a, b := rt.hostRank(), other.hostRank(); a != b {
+		return a < b
+	}
+	if a, b := len(rt.Host), len(other.Host); a != b {
+		return a > b
+	}
+	if a, b := rt.pathRank(), other.pathRank(); a != b {
+		return a < b
+	}
+	if a, b := len(rt.PathPrefix), len(other.PathPrefix); a != b {
+		return a > b
+	}
+	if a, b := len(rt.Headers), len(other.Headers); a != b {
+		return a > b
+	}
+	return len(rt.Methods) > 0 && len(other.Methods) == 0
+}
+
+func (rt *Route) hostRank() int {
+	switch {
+	case rt.Host == "":
+		return 2
+	case strings.HasPrefix(rt.Host, "*."):
+		return 1
+	default:
+		return 0
+	}
+}
+
+func (rt *Route) pathRank() int {
+	switch {
+	case rt.Path != "":
+		return 0
+	case rt.PathRegex != nil:
+		return 1
+	default:
+		return 2
+	}
+}
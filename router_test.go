@@ -0,0 +1,99 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+// testRouter builds a router from a YAML config
+func testRouter(t *testing.T, yaml string) *Router {
+	t.Helper()
+	config, err := ParseConfig("test.yaml", []byte(yaml))
+	if err != nil {
+		t.Fatal(err)
+	}
+	router, err := NewRouter(config, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return router
+}
+
+// TestPathPrefixSegments checks that path prefixes match whole segments
+func TestPathPrefixSegments(t *testing.T) {
+	router := testRouter(t, `
+pools:
+  users:
+    backends: [http://localhost:8081]
+  other:
+    backends: [http://localhost:8082]
+routes:
+  - path_prefix: /users
+    pool: users
+  - path_prefix: /
+    pool: other
+`)
+
+	tests := []struct {
+		path string
+		pool string
+	}{
+		{"/users", "users"},
+		{"/users/", "users"},
+		{"/users/1", "users"},
+		{"/usersfoo", "other"},
+		{"/users-admin/1", "other"},
+		{"/user", "other"},
+	}
+	for _, tt := range tests {
+		route := router.Match(httptest.NewRequest("GET", tt.path, nil))
+		if route == nil {
+			t.Errorf("%s: no route", tt.path)
+			continue
+		}
+		if route.Pool.Name != tt.pool {
+			t.Errorf("%s: routed to pool %s, want %s", tt.path, route.Pool.Name, tt.pool)
+		}
+	}
+}
+
+// TestHasPathPrefix covers prefixes with and without a trailing slash
+func TestHasPathPrefix(t *testing.T) {
+	tests := []struct {
+		path, prefix string
+		want         bool
+	}{
+		{"/users", "/users", true},
+		{"/users/1", "/users", true},
+		{"/usersfoo", "/users", false},
+		{"/users/1", "/users/", true},
+		{"/users", "/users/", false},
+		{"/anything", "/", true},
+	}
+	for _, tt := range tests {
+		if got := hasPathPrefix(tt.path, tt.prefix); got != tt.want {
+			t.Errorf("hasPathPrefix(%q, %q) = %v, want %v", tt.path, tt.prefix, got, tt.want)
+		}
+	}
+}
+
+// TestRewriteStripPrefix checks that strip_prefix only strips whole segments
+// and always leaves an absolute path
+func TestRewriteStripPrefix(t *testing.T) {
+	tests := []struct {
+		strip, path, want string
+	}{
+		{"/users", "/users/42", "/42"},
+		{"/users", "/users", "/"},
+		{"/users", "/usersfoo", "/usersfoo"},
+		{"/users/", "/users/42", "/42"},
+		{"/users/", "/users/", "/"},
+	}
+	for _, tt := range tests {
+		rw := &Rewrite{StripPrefix: tt.strip}
+		out := rw.Apply(httptest.NewRequest("GET", tt.path, nil))
+		if out.URL.Path != tt.want {
+			t.Errorf("strip %q from %q = %q, want %q", tt.strip, tt.path, out.URL.Path, tt.want)
+		}
+	}
+}
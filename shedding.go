@@ -0,0 +1,176 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// Tier is the priority of an API key. Under overload lower tiers are shed
+// first; critical traffic is never shed.
+type Tier int
+
+const (
+	TierAnonymous Tier = iota // requests without an API key
+	TierLow
+	TierNormal
+	TierHigh
+	TierCritical
+)
+
+var tierNames = []string{"anonymous", "low", "normal", "high", "critical"}
+
+func (t Tier) String() string {
+	if t < 0 || int(t) >= len(tierNames) {
+		return fmt.Sprintf("tier(%d)", int(t))
+	}
+	return tierNames[t]
+}
+
+// parseTier parses a tier name other than "anonymous"
+func parseTier(s string) (Tier, error) {
+	for i, name := range tierNames {
+		if name == s && Tier(i) != TierAnonymous {
+			return Tier(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown tier %q (want low, normal, high or critical)", s)
+}
+
+var errOverloaded = errors.New("gateway overloaded")
+
+// shedPressure is the load, as a multiple of the configured thresholds, at
+// which each tier starts being shed
+var shedPressure = [...]float64{
+	TierAnonymous: 1.0,
+	TierLow:       1.1,
+	TierNormal:    1.25,
+	TierHigh:      1.5,
+	TierCritical:  math.Inf(1),
+}
+
+// loadSampleInterval is how often the load shedder re-measures load
+const loadSampleInterval = 250 * time.Millisecond
+
+// LoadShedder rejects low-priority requests while the gateway is
+// overloaded. Load is the highest of process CPU use, requests queued and
+// requests in flight, each relative to its threshold; a zero threshold is
+// not checked.
+type LoadShedder struct {
+	CPU        float64 // share of all cores, 0.8 for 80%
+	QueueDepth int
+	InFlight   int
+
+	// sample reports the requests currently in flight and queued
+	sample func() (inFlight, queued int)
+
+	pressure float64
+	cpu      float64
+	sampled  time.Time
+	lastCPU  time.Duration
+	mu       sync.Mutex
+}
+
+// LoadShedder.Configure applies new thresholds; nil disables shedding
+func (ls *LoadShedder) Configure(lc *LoadSheddingConfig) {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+
+	ls.CPU, ls.QueueDepth, ls.InFlight = 0, 0, 0
+	if lc != nil {
+		ls.CPU, ls.QueueDepth, ls.InFlight = lc.CPU, lc.QueueDepth, lc.InFlight
+	}
+}
+
+// LoadShedder.Shed reports whether a request of the given tier should be
+// rejected
+func (ls *LoadShedder) Shed(tier Tier) bool {
+	return ls.Pressure() >= shedPressure[tier]
+}
+
+// LoadShedder.Pressure returns the current load relative to the thresholds,
+// where 1 means a threshold has been reached
+func (ls *LoadShedder) Pressure() float64 {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+
+	if ls.CPU == 0 && ls.QueueDepth == 0 && ls.InFlight == 0 {
+		return 0
+	}
+
+	now := time.Now()
+	if now.Sub(ls.sampled) < loadSampleInterval {
+		return ls.pressure
+	}
+
+	if cpuTime, ok := processCPUTime(); ok {
+		if !ls.sampled.IsZero() {
+			wall := now.Sub(ls.sampled) * time.Duration(runtime.NumCPU())
+			ls.cpu = float64(cpuTime-ls.lastCPU) / float64(wall)
+		}
+		ls.lastCPU = cpuTime
+	}
+	ls.sampled = now
+
+	inFlight, queued := ls.sample()
+	ls.pressure = 0
+	if ls.CPU > 0 {
+		ls.pressure = math.Max(ls.pressure, ls.cpu/ls.CPU)
+	}
+	if ls.QueueDepth > 0 {
+		ls.pressure = math.Max(ls.pressure, float64(queued)/float64(ls.QueueDepth))
+	}
+	if ls.InFlight > 0 {
+		ls.pressure = math.Max(ls.pressure, float64(inFlight)/float64(ls.InFlight))
+	}
+	return ls.pressure
+}
+
+// LoadShedder.Status describes the shedder for /health, or returns nil when
+// shedding is off
+func (ls *LoadShedder) Status() map[string]interface{} {
+	pressure := ls.Pressure()
+
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	if ls.CPU == 0 && ls.QueueDepth == 0 && ls.InFlight == 0 {
+		return nil
+	}
+
+	shedding := make([]string, 0)
+	for tier, at := range shedPressure {
+		if pressure >= at {
+			shedding = append(shedding, Tier(tier).String())
+		}
+	}
+	return map[string]interface{}{
+		"pressure": math.Round(pressure*100) / 100,
+		"cpu":      math.Round(ls.cpu*100) / 100,
+		"shedding": shedding,
+	}
+}
+
+// Gateway.load reports the proxied requests in flight and queued across all
+// backends and routes, for the load shedder
+func (g *Gateway) load() (inFlight, queued int) {
+	router := g.currentRouter()
+	for _, pool := range router.Pools() {
+		pool.LB.mu.Lock()
+		for _, b := range pool.LB.backends {
+			_, q := b.queue.Stats()
+			queued += q
+			inFlight += int(b.InFlight()) - q
+		}
+		pool.LB.mu.Unlock()
+	}
+	for _, route := range router.routes {
+		if route.Queue != nil {
+			_, q := route.Queue.Stats()
+			queued += q
+		}
+	}
+	return inFlight, queued
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/http"
+	"time"
+)
+
+const (
+	// defaultDrainDelay is how long /health fails before the listener
+	// closes, long enough for a load balancer checking every few seconds
+	// to notice
+	defaultDrainDelay = 5 * time.Second
+
+	// defaultDrainTimeout is how long shutdown waits for in-flight requests
+	defaultDrainTimeout = 30 * time.Second
+
+	// newConnGrace is how long shutdown waits for accepted connections to
+	// send their first request before closing them
+	newConnGrace = time.Second
+)
+
+// Gateway.Shutdown stops the gateway gracefully. /health starts failing so
+// upstream load balancers stop sending traffic, and after DrainDelay the
+// listener closes. In-flight requests then get up to DrainTimeout to finish
+// before their connections are closed. Finally the health checks and config
+// watcher stop and the request log is flushed and closed.
+func (g *Gateway) Shutdown() error {
+	config := g.currentConfig()
+	g.draining.Store(true)
+
+	if config.DrainDelay > 0 {
+		log.Printf("Draining: failing /health for %v before closing the listener", config.DrainDelay)
+		time.Sleep(config.DrainDelay)
+	}
+	return g.drain()
+}
+
+// Gateway.drain closes the listener, waits up to DrainTimeout for in-flight
+// requests and then stops the background loops and closes the request log.
+// After an upgrade the new process shares the listening socket, so it is
+// called directly without failing /health first.
+func (g *Gateway) drain() error {
+	config := g.currentConfig()
+	inFlight, _ := g.load()
+	log.Printf("Draining: waiting up to %v for %d in-flight requests", config.DrainTimeout, inFlight)
+
+	ctx, cancel := context.WithTimeout(context.Background(), config.DrainTimeout)
+	defer cancel()
+
+	// http.Server.Shutdown drops connections whose first request has not
+	// been read yet, so stop accepting and give those a moment to send it
+	g.mu.RLock()
+	ln := g.listener
+	g.mu.RUnlock()
+	if ln != nil {
+		ln.Close()
+		g.awaitNewConns(ctx)
+	}
+
+	if err := g.server.Shutdown(ctx); err != nil {
+		inFlight, _ := g.load()
+		log.Printf("Drain timed out with %d requests in flight, closing connections", inFlight)
+		g.server.Close()
+	} else {
+		log.Printf("Drained all requests")
+	}
+
+	close(g.stop)
+	return g.Close()
+}
+
+// Gateway.trackConn records which connections are still waiting for their
+// first request
+func (g *Gateway) trackConn(c net.Conn, state http.ConnState) {
+	g.newConnsMu.Lock()
+	defer g.newConnsMu.Unlock()
+
+	if state == http.StateNew {
+		g.newConns[c] = true
+	} else {
+		delete(g.newConns, c)
+	}
+}
+
+// Gateway.awaitNewConns waits up to newConnGrace for accepted connections to
+// send their first request
+func (g *Gateway) awaitNewConns(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, newConnGrace)
+	defer cancel()
+
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		g.newConnsMu.Lock()
+		n := len(g.newConns)
+		g.newConnsMu.Unlock()
+		if n == 0 {
+			return
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
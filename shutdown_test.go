@@ -0,0 +1,28 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// TestDrainDelay checks that drain_delay defaults to 5s and can be turned off
+func TestDrainDelay(t *testing.T) {
+	tests := []struct {
+		shutdown string
+		want     time.Duration
+	}{
+		{"", defaultDrainDelay},
+		{"shutdown:\n  drain_timeout: 10s", defaultDrainDelay},
+		{"shutdown:\n  drain_delay: 0s", 0},
+		{"shutdown:\n  drain_delay: 15s", 15 * time.Second},
+	}
+	for _, tt := range tests {
+		config, err := ParseConfig("test.yaml", []byte("backends: [http://localhost:8081]\n"+tt.shutdown))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if config.DrainDelay != tt.want {
+			t.Errorf("%q: DrainDelay = %v, want %v", tt.shutdown, config.DrainDelay, tt.want)
+		}
+	}
+}
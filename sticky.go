@@ -0,0 +1,123 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultStickyCookie is the affinity cookie name when none is configured
+const defaultStickyCookie = "gw_affinity"
+
+var (
+	// stickyProcessKey signs affinity cookies for pools without a secret. It
+	// lives as long as the process, so it survives config reloads.
+	stickyProcessKey     []byte
+	stickyProcessKeyOnce sync.Once
+)
+
+// StickySessions pins clients to a backend with a signed cookie naming it
+type StickySessions struct {
+	Cookie string
+	TTL    time.Duration
+	key    []byte
+}
+
+// newStickySessions creates cookie affinity for pool. Without a secret a
+// random per-process key is used, so cookies only work on this instance.
+func newStickySessions(pool string, sc *StickyConfig) *StickySessions {
+	ss := &StickySessions{Cookie: sc.Cookie, TTL: sc.TTL}
+	if ss.Cookie == "" {
+		ss.Cookie = defaultStickyCookie
+	}
+
+	secret := []byte(sc.Secret)
+	if len(secret) == 0 {
+		stickyProcessKeyOnce.Do(func() {
+			stickyProcessKey = make([]byte, 32)
+			rand.Read(stickyProcessKey)
+		})
+		secret = stickyProcessKey
+	}
+
+	// Bind the key to the pool so a cookie from one pool can't pin another
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(pool))
+	ss.key = mac.Sum(nil)
+	return ss
+}
+
+// StickySessions.Pinned returns the backend named by r's affinity cookie if
+// the cookie is valid and that backend can still take requests
+func (ss *StickySessions) Pinned(r *http.Request, lb *LoadBalancer) *Backend {
+	c, err := r.Cookie(ss.Cookie)
+	if err != nil {
+		return nil
+	}
+
+	id, sig, ok := strings.Cut(c.Value, ".")
+	if !ok || subtle.ConstantTimeCompare([]byte(sig), []byte(ss.sign(id))) != 1 {
+		return nil
+	}
+
+	return lb.Lookup(id)
+}
+
+// StickySessions.cookieFor returns the affinity cookie pinning a client to backend
+func (ss *StickySessions) cookieFor(backend *Backend) *http.Cookie {
+	c := &http.Cookie{
+		Name:     ss.Cookie,
+		Value:    backend.id + "." + ss.sign(backend.id),
+		Path:     "/",
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+	if ss.TTL > 0 {
+		c.MaxAge = int(ss.TTL.Seconds())
+	}
+	return c
+}
+
+func (ss *StickySessions) sign(id string) string {
+	mac := hmac.New(sha256.New, ss.key)
+	mac.Write([]byte(id))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// Pool.Next picks a backend for r. With sticky sessions a valid cookie for
+// an alive backend wins; otherwise the load balancer picks and the returned
+// cookie (re)pins the client.
+func (p *Pool) Next(r *http.Request) (*Backend, *http.Cookie) {
+	if p.Sticky == nil {
+		return p.LB.Next(r), nil
+	}
+
+	if backend := p.Sticky.Pinned(r, p.LB); backend != nil {
+		return backend, nil
+	}
+
+	backend := p.LB.Next(r)
+	if backend == nil {
+		return nil, nil
+	}
+	return backend, p.Sticky.cookieFor(backend)
+}
+
+// Pool.NextRetry returns a backend to retry r on, preferring one not in
+// tried, and the affinity cookie to set if the pool is sticky
+func (p *Pool) NextRetry(r *http.Request, tried map[*Backend]bool) (*Backend, *http.Cookie) {
+	backend := p.LB.NextExcept(r, tried)
+	if backend == nil {
+		backend = p.LB.Next(r)
+	}
+	if backend == nil || p.Sticky == nil {
+		return backend, nil
+	}
+	return backend, p.Sticky.cookieFor(backend)
+}
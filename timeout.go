@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// timeoutHeader carries a request's remaining time budget in milliseconds.
+// Clients may send it to ask for a shorter or longer deadline, and the
+// gateway sends backends what is left of the deadline.
+const timeoutHeader = "X-Request-Timeout-Ms"
+
+// Timeout defaults. The total matches the server write timeout the gateway
+// used before routes had their own.
+const (
+	defaultTotalTimeout = 15 * time.Second
+	defaultDialTimeout  = 30 * time.Second
+)
+
+// writeGrace is how long past a request's deadline the gateway may still
+// spend writing its response, long enough to send a 504 to a client that is
+// reading
+const writeGrace = 5 * time.Second
+
+// Timeouts bound how long a route's requests may take upstream. Connect
+// limits dialing a backend, ResponseHeader waiting for its response headers
+// once the request is sent, and Total the whole request including retries.
+// MaxClient caps the deadline a client may ask for with timeoutHeader.
+// Zero means no limit.
+type Timeouts struct {
+	Connect        time.Duration
+	ResponseHeader time.Duration
+	Total          time.Duration
+	MaxClient      time.Duration
+}
+
+// timeoutsKey carries a request's Timeouts in its context for the upstream
+// transport
+type timeoutsKey struct{}
+
+// errResponseHeaderTimeout is returned when a backend is slower than the
+// route's response header timeout
+var errResponseHeaderTimeout error = &timeoutError{"timeout awaiting response headers"}
+
+// timeoutError is a net.Error that reports a timeout
+type timeoutError struct {
+	msg string
+}
+
+func (e *timeoutError) Error() string   { return e.msg }
+func (e *timeoutError) Timeout() bool   { return true }
+func (e *timeoutError) Temporary() bool { return true }
+
+// newTimeouts returns the timeouts for a route: the gateway-wide settings
+// with any set on the route itself taking precedence
+func newTimeouts(global TimeoutConfig, route *TimeoutConfig) Timeouts {
+	t := Timeouts{
+		Connect:        global.Connect,
+		ResponseHeader: global.ResponseHeader,
+		Total:          global.Total,
+		MaxClient:      global.MaxClient,
+	}
+	if route != nil {
+		if route.Connect != 0 {
+			t.Connect = route.Connect
+		}
+		if route.ResponseHeader != 0 {
+			t.ResponseHeader = route.ResponseHeader
+		}
+		if route.Total != 0 {
+			t.Total = route.Total
+		}
+		if route.MaxClient != 0 {
+			t.MaxClient = route.MaxClient
+		}
+	}
+	if t.MaxClient == 0 {
+		t.MaxClient = t.Total
+	}
+	return t
+}
+
+// Timeouts.deadline returns how long r may take: the route's total, or the
+// client's requested timeout capped at MaxClient
+func (t Timeouts) deadline(r *http.Request) time.Duration {
+	total := t.Total
+	if v := r.Header.Get(timeoutHeader); v != "" {
+		if ms, err := strconv.ParseInt(v, 10, 64); err == nil && ms > 0 {
+			total = time.Duration(ms) * time.Millisecond
+			if t.MaxClient > 0 && total > t.MaxClient {
+				total = t.MaxClient
+			}
+		}
+	}
+	return total
+}
+
+// Timeouts.SetWriteDeadline bounds writing r's response to its deadline
+// plus writeGrace, so a client that stops reading can't hold the connection
+// open. It takes the place of a server-wide write timeout, which can't fit
+// every route's deadline.
+func (t Timeouts) SetWriteDeadline(w http.ResponseWriter, r *http.Request) {
+	if total := t.deadline(r); total > 0 {
+		http.NewResponseController(w).SetWriteDeadline(time.Now().Add(total + writeGrace))
+	}
+}
+
+// Timeouts.Context returns a context for r bounded by its deadline and
+// carrying the timeouts for the upstream transport
+func (t Timeouts) Context(r *http.Request) (context.Context, context.CancelFunc) {
+	ctx := context.WithValue(r.Context(), timeoutsKey{}, t)
+	if total := t.deadline(r); total > 0 {
+		return context.WithTimeout(ctx, total)
+	}
+	return context.WithCancel(ctx)
+}
+
+// upstreamTransport is shared by all backends. It applies the connect and
+// response header timeouts of each request's route and tells the backend
+// how much of the deadline remains.
+var upstreamTransport = newUpstreamTransport()
+
+func newUpstreamTransport() http.RoundTripper {
+	dialer := &net.Dialer{Timeout: defaultDialTimeout, KeepAlive: 30 * time.Second}
+
+	base := http.DefaultTransport.(*http.Transport).Clone()
+	base.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if t, ok := ctx.Value(timeoutsKey{}).(Timeouts); ok && t.Connect > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, t.Connect)
+			defer cancel()
+		}
+		return dialer.DialContext(ctx, network, addr)
+	}
+	return &timeoutTransport{base: base}
+}
+
+// timeoutTransport enforces per-request response header timeouts
+type timeoutTransport struct {
+	base http.RoundTripper
+}
+
+func (tt *timeoutTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	if deadline, ok := ctx.Deadline(); ok {
+		req = req.Clone(ctx)
+		remaining := time.Until(deadline).Milliseconds()
+		if remaining < 1 {
+			remaining = 1
+		}
+		req.Header.Set(timeoutHeader, strconv.FormatInt(remaining, 10))
+	}
+
+	t, _ := ctx.Value(timeoutsKey{}).(Timeouts)
+	if t.ResponseHeader <= 0 {
+		return tt.base.RoundTrip(req)
+	}
+
+	ctx, cancel := context.WithCancelCause(ctx)
+	timer := time.AfterFunc(t.ResponseHeader, func() {
+		cancel(errResponseHeaderTimeout)
+	})
+	resp, err := tt.base.RoundTrip(req.WithContext(ctx))
+	timer.Stop()
+	if err != nil {
+		if context.Cause(ctx) == errResponseHeaderTimeout {
+			err = errResponseHeaderTimeout
+		}
+		cancel(nil)
+		return nil, err
+	}
+
+	// The body still needs the context; release it when the proxy is done
+	resp.Body = &cancelBody{ReadCloser: resp.Body, cancel: func() { cancel(nil) }}
+	return resp, nil
+}
+
+// cancelBody cancels a request's context once its response body is closed
+type cancelBody struct {
+	io.ReadCloser
+	cancel func()
+}
+
+func (b *cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// isTimeout reports whether err means a deadline or timeout was exceeded
+func isTimeout(err error) bool {
+	var ne net.Error
+	return errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &ne) && ne.Timeout())
+}
+
+// writeTimeout replies 504 with a JSON error
+func writeTimeout(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusGatewayTimeout)
+	json.NewEncoder(w).Encode(map[string]string{"error": "upstream request timed out"})
+}
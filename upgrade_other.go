@@ -0,0 +1,26 @@
+//go:build !unix
+
+package main
+
+import (
+	"errors"
+	"net"
+	"os"
+)
+
+// listen opens the gateway's listening socket. Listener handoff is not
+// available on this platform, so it always binds a new one.
+func listen(addr string) (net.Listener, error) {
+	return net.Listen("tcp", addr)
+}
+
+// notifyReady is a no-op since this process is never started by an upgrade
+func notifyReady() {}
+
+// notifyUpgrade is a no-op since there is no SIGUSR2 on this platform
+func notifyUpgrade(c chan<- os.Signal) {}
+
+// Gateway.Upgrade is not supported on this platform
+func (g *Gateway) Upgrade() error {
+	return errors.New("binary upgrades are not supported on this platform")
+}
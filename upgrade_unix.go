@@ -0,0 +1,133 @@
+//go:build unix
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// upgradeEnv marks a process started by an upgrade. Its listening socket is
+// inherited as fd 3 and it reports readiness by writing to the pipe on fd 4.
+const (
+	upgradeEnv          = "GATEWAY_UPGRADE"
+	upgradeListenerFD   = 3
+	upgradeReadyFD      = 4
+	upgradeReadyTimeout = 30 * time.Second
+)
+
+// listen returns the listening socket handed over by the parent process
+// during an upgrade, or binds a new one
+func listen(addr string) (net.Listener, error) {
+	if os.Getenv(upgradeEnv) == "" {
+		return net.Listen("tcp", addr)
+	}
+
+	f := os.NewFile(upgradeListenerFD, "listener")
+	defer f.Close()
+	ln, err := net.FileListener(f)
+	if err != nil {
+		return nil, fmt.Errorf("inherit listener: %w", err)
+	}
+	log.Printf("Inherited listener on %s from parent process %d", ln.Addr(), os.Getppid())
+	return ln, nil
+}
+
+// notifyReady tells the parent process that this one is accepting
+// connections, so it can start draining
+func notifyReady() {
+	if os.Getenv(upgradeEnv) == "" {
+		return
+	}
+	os.Unsetenv(upgradeEnv)
+
+	f := os.NewFile(upgradeReadyFD, "ready")
+	defer f.Close()
+	if _, err := f.Write([]byte{1}); err != nil {
+		log.Printf("Failed to notify parent process: %v", err)
+	}
+}
+
+// notifyUpgrade relays SIGUSR2 to c
+func notifyUpgrade(c chan<- os.Signal) {
+	signal.Notify(c, syscall.SIGUSR2)
+}
+
+// Gateway.Upgrade starts a new gateway process from the current executable,
+// passing it the listening socket, and waits until it is accepting
+// connections. The caller then drains this process. If the new process exits
+// or does not become ready in time, this one keeps serving.
+func (g *Gateway) Upgrade() error {
+	g.mu.RLock()
+	ln := g.listener
+	g.mu.RUnlock()
+	if ln == nil {
+		return errors.New("gateway is not listening")
+	}
+	tcp, ok := ln.(*net.TCPListener)
+	if !ok {
+		return fmt.Errorf("cannot hand off %T", ln)
+	}
+
+	lnFile, err := tcp.File()
+	if err != nil {
+		return fmt.Errorf("duplicate listener: %w", err)
+	}
+	defer lnFile.Close()
+
+	ready, readyW, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer ready.Close()
+
+	path, err := os.Executable()
+	if err != nil {
+		readyW.Close()
+		return err
+	}
+
+	env := []string{upgradeEnv + "=1"}
+	for _, kv := range os.Environ() {
+		if !strings.HasPrefix(kv, upgradeEnv+"=") {
+			env = append(env, kv)
+		}
+	}
+
+	cmd := exec.Command(path, os.Args[1:]...)
+	cmd.Env = env
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.ExtraFiles = []*os.File{lnFile, readyW}
+	err = cmd.Start()
+	readyW.Close()
+	if err != nil {
+		return fmt.Errorf("start %s: %w", path, err)
+	}
+	log.Printf("Started new gateway process %d from %s", cmd.Process.Pid, path)
+
+	exited := make(chan error, 1)
+	go func() {
+		exited <- cmd.Wait()
+	}()
+
+	ready.SetReadDeadline(time.Now().Add(upgradeReadyTimeout))
+	buf := make([]byte, 1)
+	if _, err := ready.Read(buf); err != nil {
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			cmd.Process.Kill()
+			return fmt.Errorf("new process %d not ready after %v", cmd.Process.Pid, upgradeReadyTimeout)
+		}
+		return fmt.Errorf("new process %d exited: %v", cmd.Process.Pid, <-exited)
+	}
+
+	log.Printf("New gateway process %d is ready", cmd.Process.Pid)
+	return nil
+}